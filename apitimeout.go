@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// apiTimeoutTransport is an http.RoundTripper that gives up on each Kubernetes API request after
+// -api-timeout, so that a connection that hangs, as through a misbehaving load balancer, can't stall
+// a reconcile, or the informers' lists, indefinitely. The timeout covers reading the response as
+// well, except for a watch, where it only covers the watch being established, since the watch
+// itself is meant to stay open.
+type apiTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+// wrapAPITimeout is a transport wrapper for a rest.Config, applying -api-timeout to every request
+// made through it, if it's set.
+func wrapAPITimeout(rt http.RoundTripper) http.RoundTripper {
+	if apiTimeout <= 0 {
+		return rt
+	}
+
+	return &apiTimeoutTransport{next: rt, timeout: apiTimeout}
+}
+
+// RoundTrip makes the request, cancelling it if the timeout passes first.
+func (t *apiTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+	// A watch that's been established is left open. If the timeout passed just as it was, it's been
+	// cancelled anyway, and the informer watching starts another.
+	if req.URL.Query().Get("watch") == "true" {
+		timer.Stop()
+	}
+	if err != nil {
+		if ctx.Err() != nil && req.Context().Err() == nil {
+			err = fmt.Errorf("no response within the api timeout of %s: %w", t.timeout, err)
+		}
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() {
+		timer.Stop()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// cancelOnClose is a response body that cancels the request's context once it's closed, so that the
+// timeout carries on while the body is being read, but no longer.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the context.
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// statefulSetGetter returns the StatefulSet to predict nodes from, or nil if it doesn't exist.
+type statefulSetGetter func() (*appsv1.StatefulSet, error)
+
+// bootstrapNamespace returns the namespace of the StatefulSet to predict nodes from, which is this
+// sidecar's own namespace, given by -pod-namespace, or else the first namespace.
+func bootstrapNamespace() string {
+	return cmp.Or(podNamespace, namespaces[0])
+}
+
+// bootstrapStatefulSetName returns the name of the StatefulSet to predict nodes from. That's the one
+// given by -bootstrap-statefulset, or else the one owning this sidecar's pod, given by -pod-name.
+func bootstrapStatefulSetName(ctx context.Context, clients kubernetes.Interface) (string, error) {
+	if bootstrapStatefulSet != "" {
+		return bootstrapStatefulSet, nil
+	}
+
+	name := podName
+	if name == "" {
+		return "", errors.New("-bootstrap-statefulset isn't set and -pod-name isn't available to find it from")
+	}
+
+	pod, err := clients.CoreV1().Pods(bootstrapNamespace()).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get own pod %s: %w", name, err)
+	}
+
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "StatefulSet" && ref.Controller != nil && *ref.Controller {
+			return ref.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("own pod %s isn't owned by a StatefulSet", name)
+}
+
+// newStatefulSetCache returns an informer caching the named StatefulSet in the bootstrap namespace,
+// the informer factory that must be started for it to run, and a statefulSetGetter that gets it from
+// its cache.
+func newStatefulSetCache(clients kubernetes.Interface, name string) (informers.SharedInformerFactory, cache.SharedIndexInformer, statefulSetGetter) {
+	ns := bootstrapNamespace()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clients, resyncInterval,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+
+	statefulSets := factory.Apps().V1().StatefulSets()
+	lister := statefulSets.Lister().StatefulSets(ns)
+
+	return factory, statefulSets.Informer(), func() (*appsv1.StatefulSet, error) {
+		sts, err := lister.Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return sts, err
+	}
+}
+
+// getStatefulSetOnce returns a statefulSetGetter for the named StatefulSet in the bootstrap
+// namespace, as got from the API server once, without going through an informer.
+func getStatefulSetOnce(ctx context.Context, clients kubernetes.Interface, name string) (statefulSetGetter, error) {
+	sts, err := clients.AppsV1().StatefulSets(bootstrapNamespace()).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		sts, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (*appsv1.StatefulSet, error) { return sts, nil }, nil
+}
+
+// bootstrapping reports whether the nodes listed are those predicted from the StatefulSet, rather
+// than those discovered. It's only meaningful with -bootstrap-from-statefulset.
+var bootstrapping atomic.Bool
+
+// bootstrapSince is when bootstrapping last started, and bootstrapSize the number of nodes predicted
+// as of the last reconcile. bootstrapTimedOut is whether the bootstrap timeout action has been taken
+// since then.
+var bootstrapSince time.Time
+var bootstrapSize int
+var bootstrapTimedOut bool
+
+// errBootstrapTimedOut is returned by bootstrapNodes when none of the predicted nodes could be reached
+// by the bootstrap timeout, and -bootstrap-timeout-action is exit.
+var errBootstrapTimedOut = errors.New("timed out bootstrapping, no nodes discovered and none of the predicted nodes reachable")
+
+// bootstrapNodes returns the given nodes, unless bootstrapping from a StatefulSet, in which case it
+// returns the nodes predicted from the StatefulSet instead. Bootstrapping starts whenever no nodes
+// are discovered, and carries on until at least -bootstrap-handover of the predicted nodes have been
+// discovered, or -bootstrap-timeout has passed, so that the first few pods to become ready don't
+// replace the whole predicted list. Static nodes don't count as discovered, and are added back
+// afterwards.
+//
+// If no nodes at all have been discovered by the bootstrap timeout, the predicted nodes are health
+// checked, and if none of them can be reached, -bootstrap-timeout-action is taken.
+func bootstrapNodes(ctx context.Context, nodes []discovery.Endpoint, get statefulSetGetter) ([]discovery.Endpoint, error) {
+	if !bootstrapFromStatefulSet || len(nodes) > 0 && !bootstrapping.Load() {
+		return nodes, nil
+	}
+
+	if len(nodes) > 0 {
+		need := int(math.Ceil(bootstrapHandover * float64(bootstrapSize)))
+		since := time.Since(bootstrapSince)
+
+		switch {
+		case len(nodes) >= need:
+			slog.Info("leaving bootstrap mode, enough nodes discovered", "node_count", len(nodes), "predicted", bootstrapSize, "since", bootstrapSince)
+			setBootstrapping(false)
+			return nodes, nil
+		case bootstrapTimeout > 0 && since >= bootstrapTimeout:
+			slog.Warn("leaving bootstrap mode, timed out waiting for nodes to be discovered", "node_count", len(nodes), "predicted", bootstrapSize, "since", bootstrapSince)
+			setBootstrapping(false)
+			return nodes, nil
+		}
+
+		slog.Debug("too few nodes discovered to leave bootstrap mode", "node_count", len(nodes), "need", need, "since", bootstrapSince)
+	}
+
+	sts, err := get()
+	if err != nil {
+		return nil, err
+	}
+	if sts == nil {
+		if bootstrapping.Load() {
+			slog.Warn("leaving bootstrap mode, statefulset no longer exists")
+			setBootstrapping(false)
+		}
+		return nodes, nil
+	}
+
+	predicted := predictNodes(sts)
+	bootstrapSize = len(predicted)
+
+	if !bootstrapping.Load() {
+		slog.Info("no nodes found, entering bootstrap mode", "statefulset", sts.Namespace+"/"+sts.Name, "node_count", len(predicted))
+		bootstrapSince = time.Now()
+		bootstrapTimedOut = false
+		setBootstrapping(true)
+	}
+
+	if bootstrapTimeout > 0 && time.Since(bootstrapSince) >= bootstrapTimeout && !bootstrapTimedOut && !anyReachable(ctx, predicted) {
+		bootstrapTimedOut = true
+
+		if bootstrapTimeoutAction == "exit" {
+			slog.Error("bootstrap timed out, exiting: no nodes discovered and none of the predicted nodes reachable", "statefulset", sts.Namespace+"/"+sts.Name, "since", bootstrapSince)
+			return nil, errBootstrapTimedOut
+		}
+
+		slog.Error("bootstrap timed out, keeping the predicted nodes: no nodes discovered and none of them reachable", "statefulset", sts.Namespace+"/"+sts.Name, "since", bootstrapSince)
+	}
+
+	return predicted, nil
+}
+
+// anyReachable reports whether any of the given nodes passes its health check.
+func anyReachable(ctx context.Context, nodes []discovery.Endpoint) bool {
+	for _, err := range prober.probeAll(ctx, nodes) {
+		if err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setBootstrapping records whether bootstrapping.
+func setBootstrapping(b bool) {
+	bootstrapping.Store(b)
+
+	if b {
+		bootstrapGauge.Set(1)
+	} else {
+		bootstrapGauge.Set(0)
+	}
+}
+
+// predictionKey returns the number of nodes predicted from the StatefulSet and the service they're
+// under, as a string, so that it can be compared to tell if a change to the StatefulSet matters.
+func predictionKey(sts *appsv1.StatefulSet) string {
+	return fmt.Sprintf("%d/%s", len(predictNodes(sts)), sts.Spec.ServiceName)
+}
+
+// predictNodes returns the nodes the pods of the StatefulSet will be, by their stable DNS names
+// under its governing service, as there are no pod IPs to list them by yet.
+func predictNodes(sts *appsv1.StatefulSet) []discovery.Endpoint {
+	replicas := 1
+	if sts.Spec.Replicas != nil {
+		replicas = int(*sts.Spec.Replicas)
+	}
+
+	nodes := make([]discovery.Endpoint, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		nodes = append(nodes, discovery.Endpoint{
+			Namespace: sts.Namespace,
+			Service:   sts.Spec.ServiceName,
+			IP:        fmt.Sprintf("%s-%d.%s.%s.svc.%s", sts.Name, i, sts.Spec.ServiceName, sts.Namespace, clusterDomain),
+			Pod:       fmt.Sprintf("%s-%d", sts.Name, i),
+			PeerPort:  peerPort,
+			APIPort:   apiPort,
+		})
+	}
+
+	return nodes
+}
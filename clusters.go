@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// remoteKubeconfigs holds the values of the -remote-kubeconfig flag.
+var remoteKubeconfigs []string
+
+// cluster is a Kubernetes cluster that nodes are discovered in.
+type cluster struct {
+	// name identifies a remote cluster in logs, and is empty for the local cluster.
+	name    string
+	clients kubernetes.Interface
+}
+
+// remoteClusters returns the remote clusters given by the -remote-kubeconfig flags. Each is given as
+// the path to a kubeconfig, optionally followed by a colon and the context to use, and is named
+// after that context.
+func remoteClusters() ([]cluster, error) {
+	clusters := make([]cluster, 0, len(remoteKubeconfigs))
+
+	for _, spec := range remoteKubeconfigs {
+		path, context, _ := strings.Cut(spec, ":")
+
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+			&clientcmd.ConfigOverrides{CurrentContext: context},
+		)
+
+		raw, err := clientConfig.RawConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load remote kubeconfig from %s: %w", path, err)
+		}
+
+		name := raw.CurrentContext
+		if context != "" {
+			name = context
+		}
+		if name == "" {
+			name = path
+		}
+
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build remote config from %s: %w", path, err)
+		}
+
+		clients, err := newClients(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client for remote cluster %s: %w", name, err)
+		}
+
+		slog.Info("loaded remote kubernetes config", "cluster", name, "source", path, "host", config.Host)
+		clusters = append(clusters, cluster{name: name, clients: clients})
+	}
+
+	return clusters, nil
+}
+
+// inCluster returns the given nodes, recording that they were discovered in the named cluster.
+func inCluster(name string, nodes []discovery.Endpoint) []discovery.Endpoint {
+	for i := range nodes {
+		nodes[i].Cluster = name
+	}
+
+	return nodes
+}
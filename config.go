@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that flags can be set by instead, e.g.
+// $TSNS_NODES_FILE for -nodes-file.
+const envPrefix = "TSNS_"
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 10 * time.Second
+
+// reloadable are the flags whose values are applied straight away when they change in the config
+// file. Any others only take effect on restart.
+var reloadable = []string{
+	"debounce",
+	"debounce-max",
+	"debug",
+	"extra-nodes",
+	"include-not-ready-below",
+	"log-level",
+	"min-nodes",
+	"min-nodes-override-after",
+	"ready-staleness",
+	"verify-peers",
+	"verify-peers-timeout",
+}
+
+// flagSources records where each flag's value came from: the command line, the environment, the
+// config file, or the flag's default.
+var flagSources = make(map[string]string)
+
+// configValues holds the settings last read from the config file, and pendingConfig those read
+// since that are yet to be applied.
+var configValues map[string]configValue
+var pendingConfig atomic.Pointer[map[string]configValue]
+
+// configValue is a setting in the config file, with the line it's on.
+type configValue struct {
+	value string
+	line  int
+}
+
+// envName returns the name of the environment variable that sets the named flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setFlagsFromEnv sets each flag that wasn't given on the command line from its environment
+// variable, if that's set, so that flags take precedence over the environment, and the environment
+// over the defaults.
+func setFlagsFromEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var errs []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			flagSources[f.Name] = "flag"
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			flagSources[f.Name] = "default"
+			return
+		}
+
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value %q for $%s: %v", value, envName(f.Name), err))
+			return
+		}
+
+		flagSources[f.Name] = "env"
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// loadConfigFile sets each flag that's still at its default from the config file given by -config,
+// if there is one, so that the environment takes precedence over the file, and the file over the
+// defaults.
+func loadConfigFile() error {
+	if configFile == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for name, v := range values {
+		if flagSources[name] != "default" {
+			continue
+		}
+
+		if err := flag.Lookup(name).Value.Set(v.value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: invalid value %q for %s: %v", configFile, v.line, v.value, name, err))
+			continue
+		}
+
+		flagSources[name] = "file"
+	}
+
+	if len(errs) > 0 {
+		slices.Sort(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	configValues = values
+	return nil
+}
+
+// readConfigFile returns the settings in the config file at path, which is a mapping of flag names
+// to values, or to lists of values that are joined by commas.
+func readConfigFile(path string) (map[string]configValue, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]configValue)
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: must be a mapping of flag names to values", path, root.Line)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+
+		name := key.Value
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, key.Line, name)
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set more than once", path, key.Line, name)
+		}
+
+		var value string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			value = node.Value
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(node.Content))
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s:%d: %s must be a list of values", path, item.Line, name)
+				}
+				items = append(items, item.Value)
+			}
+			value = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s:%d: %s must be a value or a list of values", path, node.Line, name)
+		}
+
+		values[name] = configValue{value: value, line: node.Line}
+	}
+
+	return values, nil
+}
+
+// watchConfigFile checks the config file for changes every configPollInterval until ctx is done,
+// leaving any changed settings for applyConfigChanges and reconciling to apply them. The file is
+// polled rather than watched, as a ConfigMap volume replaces the directory it's in rather than the
+// file itself.
+func watchConfigFile(ctx context.Context, events chan<- string) {
+	last, _ := os.ReadFile(configFile)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		b, err := os.ReadFile(configFile)
+		if err != nil {
+			slog.Warn("failed to read config file, keeping the current settings", "file", configFile, "error", err)
+			continue
+		}
+		if bytes.Equal(b, last) {
+			continue
+		}
+		last = b
+
+		values, err := readConfigFile(configFile)
+		if err != nil {
+			slog.Error("invalid config file, keeping the current settings", "file", configFile, "error", err)
+			continue
+		}
+
+		pendingConfig.Store(&values)
+
+		select {
+		case events <- reasonConfig:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyConfigChanges applies the settings changed in the config file since it was last read, if
+// any, for any flags not given on the command line or in the environment. A setting removed from
+// the file goes back to its default. Settings that can't be changed at runtime are only logged.
+// The health state's lock is held throughout, as the health endpoints read some of the settings.
+func applyConfigChanges() {
+	pending := pendingConfig.Swap(nil)
+	if pending == nil {
+		return
+	}
+	values := *pending
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	var changed, restart []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if source := flagSources[f.Name]; source != "file" && source != "default" {
+			return
+		}
+
+		old, hadOld := configValues[f.Name]
+		v, ok := values[f.Name]
+		if ok == hadOld && v.value == old.value {
+			return
+		}
+
+		if !slices.Contains(reloadable, f.Name) {
+			restart = append(restart, f.Name)
+			return
+		}
+
+		value, source := v.value, "file"
+		if !ok {
+			value, source = f.DefValue, "default"
+		}
+
+		if err := f.Value.Set(value); err != nil {
+			slog.Error("invalid value in config file, keeping the current one", "file", configFile, "line", v.line, "setting", f.Name, "value", value, "error", err)
+			return
+		}
+
+		flagSources[f.Name] = source
+		changed = append(changed, f.Name)
+	})
+
+	configValues = values
+
+	if slices.Contains(changed, "extra-nodes") {
+		if nodes, err := parseStaticNodes(); err != nil {
+			slog.Error("invalid extra nodes in config file, keeping the current ones", "file", configFile, "error", err)
+		} else {
+			staticNodes = nodes
+		}
+	}
+
+	nodeOptions.IncludeNotReadyBelow = includeNotReadyBelow
+
+	if slices.Contains(changed, "log-level") || slices.Contains(changed, "debug") {
+		if err := setupLogging(); err != nil {
+			slog.Error("invalid logging configuration in config file", "file", configFile, "error", err)
+		}
+	}
+
+	if len(changed) > 0 {
+		slog.Info("applied config file changes", "file", configFile, "settings", changed)
+	}
+
+	if len(restart) > 0 {
+		slog.Warn("config file changes need a restart to take effect", "file", configFile, "settings", restart)
+	}
+}
+
+// logConfig logs the value of each flag that was given on the command line, set from the
+// environment or set from the config file, grouped by which, and at debug level those left at their
+// defaults.
+func logConfig() {
+	groups := map[string][]any{}
+	flag.VisitAll(func(f *flag.Flag) {
+		source := flagSources[f.Name]
+		groups[source] = append(groups[source], slog.String(f.Name, f.Value.String()))
+	})
+
+	slog.Info("loaded configuration", slog.Group("flag", groups["flag"]...), slog.Group("env", groups["env"]...), slog.Group("file", groups["file"]...))
+	slog.Debug("default configuration", groups["default"]...)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/sink"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The keys of the ConfigMap the node list is published to. Consumers rely on these, so they must
+// not change.
+const (
+	// configMapNodesKey holds the node list, in the Typesense nodes file format whatever -format is.
+	configMapNodesKey = "nodes"
+
+	// configMapUpdatedKey holds the time the node list was last published, in RFC 3339 format.
+	configMapUpdatedKey = "updated"
+
+	// configMapGenerationKey holds the number of times the node list has been published, which
+	// increases by one each time it changes.
+	configMapGenerationKey = "generation"
+)
+
+// configMapSink is a sink.Sink that upserts the ConfigMap named by the -output-configmap flag with
+// the node list. The ConfigMap is in the first of the namespaces being watched, unless the flag gives
+// a namespace as well, as in namespace/name. Like any sink other than the nodes files, it's only
+// written when the node list differs from what was last published, and failures are only logged, so
+// they never get in the way of the nodes file, and publishing is tried again on the next reconcile.
+type configMapSink struct {
+	clients kubernetes.Interface
+}
+
+// configMapName returns the namespace and name of the ConfigMap given by -output-configmap.
+func configMapName() (string, string) {
+	if i := strings.Index(outputConfigMap, "/"); i >= 0 {
+		return outputConfigMap[:i], outputConfigMap[i+1:]
+	}
+
+	return namespaces[0], outputConfigMap
+}
+
+// Name returns the ConfigMap, as configmap/namespace/name.
+func (s *configMapSink) Name() string {
+	ns, name := configMapName()
+	return "configmap/" + ns + "/" + name
+}
+
+// Write publishes the node list to the ConfigMap.
+func (s *configMapSink) Write(ctx context.Context, list sink.NodeList) error {
+	clients, nodes := s.clients, list.Nodes
+	ns, name := configMapName()
+
+	var generation int
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMaps := clients.CoreV1().ConfigMaps(ns)
+
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			generation = 1
+			_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+				Data:       configMapData(nodes, generation),
+			}, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Something else created it first, so try again as an update.
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		// The generation is kept in the ConfigMap itself, so that it keeps increasing across
+		// restarts.
+		previous, _ := strconv.Atoi(cm.Data[configMapGenerationKey])
+		generation = previous + 1
+
+		cm = cm.DeepCopy()
+		if cm.Data == nil {
+			cm.Data = make(map[string]string, 3)
+		}
+		for k, v := range configMapData(nodes, generation) {
+			cm.Data[k] = v
+		}
+
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		configMapFailuresTotal.Inc()
+		return err
+	}
+
+	slog.Info("published node list", "configmap", ns+"/"+name, "node_count", discovery.Count(nodes), "generation", generation)
+	return nil
+}
+
+// configMapData returns the ConfigMap data for the given node list and generation.
+func configMapData(nodes string, generation int) map[string]string {
+	return map[string]string{
+		configMapNodesKey:      nodes,
+		configMapUpdatedKey:    time.Now().UTC().Format(time.RFC3339),
+		configMapGenerationKey: strconv.Itoa(generation),
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+// resolveServiceNodes builds the node list for the given headless service in the given namespace from
+// DNS, in DNS discovery mode. With -peer-port-name or -api-port-name, the SRV records for those
+// ports give the pods and their ports, and otherwise the service's A or AAAA records give the pods,
+// listed with -peer-port and -api-port. A service with no ready pods has no records at all, and so
+// no nodes.
+func resolveServiceNodes(ctx context.Context, ns, svc string) ([]discovery.Endpoint, error) {
+	host := fmt.Sprintf("%s.%s.svc.%s", svc, ns, clusterDomain)
+
+	if peerPortName == "" && apiPortName == "" {
+		ips, err := lookupIPs(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes := make([]discovery.Endpoint, 0, len(ips))
+		for _, ip := range ips {
+			nodes = append(nodes, discovery.Endpoint{Namespace: ns, Service: svc, IP: ip, PeerPort: peerPort, APIPort: apiPort})
+		}
+
+		return nodes, nil
+	}
+
+	peers, err := lookupPorts(ctx, peerPortName, host)
+	if err != nil {
+		return nil, err
+	}
+
+	apis, err := lookupPorts(ctx, apiPortName, host)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, 0, len(peers)+len(apis))
+	for target := range peers {
+		targets = append(targets, target)
+	}
+	for target := range apis {
+		if _, ok := peers[target]; !ok {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+
+	nodes := make([]discovery.Endpoint, 0, len(targets))
+	for _, target := range targets {
+		ips, err := lookupIPs(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			continue
+		}
+
+		n := discovery.Endpoint{
+			Namespace: ns,
+			Service:   svc,
+			IP:        ips[0],
+			Hostname:  strings.SplitN(target, ".", 2)[0],
+			PeerPort:  peerPort,
+			APIPort:   apiPort,
+		}
+
+		if port, ok := peers[target]; ok {
+			n.PeerPort = port
+		}
+		if port, ok := apis[target]; ok {
+			n.APIPort = port
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+// lookupPorts returns the port of each target of the SRV records for the named port of the service
+// at the given host, or nothing if the name is empty.
+func lookupPorts(ctx context.Context, name, host string) (map[string]int, error) {
+	ports := make(map[string]int)
+	if name == "" {
+		return ports, nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, name, "tcp", host)
+	if isNotFound(err) {
+		return ports, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		ports[strings.TrimSuffix(r.Target, ".")] = int(r.Port)
+	}
+
+	return ports, nil
+}
+
+// lookupIPs returns the addresses of the given host in the IP family given by -ip-family, or none if
+// it doesn't exist.
+func lookupIPs(ctx context.Context, host string) ([]string, error) {
+	ips, err := resolveIPs(ctx, host)
+	if isNotFound(err) {
+		return nil, nil
+	}
+
+	return ips, err
+}
+
+// resolveIPs returns the addresses of the given host in the IP family given by -ip-family, sorted.
+func resolveIPs(ctx context.Context, host string) ([]string, error) {
+	network := "ip4"
+	if ipFamily == "ipv6" {
+		network = "ip6"
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	slices.Sort(addrs)
+
+	return addrs, nil
+}
+
+// isNotFound reports whether err is a DNS lookup finding no such host, or no records for it.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// dnsIncompatible returns the flags set that need the Kubernetes API, and so can't be used in DNS
+// discovery mode.
+func dnsIncompatible() []string {
+	var set []string
+	for name, on := range map[string]bool{
+		"-remote-kubeconfig":          len(remoteKubeconfigs) > 0,
+		"-leader-elect":               leaderElect,
+		"-output-configmap":           outputConfigMap != "",
+		"-events":                     recordEvents,
+		"-address-source=external":    addressSource == "external",
+		"-bootstrap-from-statefulset": bootstrapFromStatefulSet,
+		"-selector":                   selector != "",
+		"-exclude-annotation":         excludeAnnotation != "",
+		"-state-annotation":           stateAnnotation != "",
+		"-exclude-terminating":        excludeTerminating,
+		"-require-container-ready":    requireContainerReady,
+		"-hostnames-from-pods":        hostnamesFromPods,
+		"-same-zone-only":             sameZoneOnly,
+		"-node-selector":              nodeSelector != "",
+		"-peer-port-annotation":       peerPortAnnotation != "",
+		"-api-port-annotation":        apiPortAnnotation != "",
+		"-use-endpointslices":         useEndpointSlices,
+	} {
+		if on {
+			set = append(set, name)
+		}
+	}
+	slices.Sort(set)
+
+	return set
+}
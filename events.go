@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+
+	corev1 "k8s.io/api/core/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// The reasons of the Kubernetes Events recorded for changes to the nodes file.
+const (
+	eventNodesUpdated     = "NodesUpdated"
+	eventNodesWriteFailed = "NodesWriteFailed"
+)
+
+// The rate limit on Events, so that flapping endpoints don't flood the namespace. A burst of Events
+// is let through, after which one more is allowed every eventInterval seconds.
+const (
+	eventBurst    = 5
+	eventInterval = 60
+)
+
+// recorder records Kubernetes Events about the nodes file, or is nil if -events isn't set.
+var recorder record.EventRecorder
+
+// eventObject is what Events are recorded against: this sidecar's pod, if its name and namespace are
+// known, or the first of the services otherwise.
+var eventObject *corev1.ObjectReference
+
+// startEvents sets up the recorder, sending Events through the given clients, if -events is set.
+func startEvents(clients kubernetes.Interface) {
+	if !recordEvents || dryRun {
+		return
+	}
+
+	eventObject = &corev1.ObjectReference{Kind: "Service", APIVersion: "v1", Namespace: namespaces[0], Name: services[0]}
+	if podName != "" && podNamespace != "" {
+		eventObject = &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: podNamespace, Name: podName}
+	}
+
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       1.0 / eventInterval,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clients.CoreV1().Events(eventObject.Namespace)})
+	recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "tsns"})
+}
+
+// recordNodesUpdated records an Event for the nodes file having changed from one node list to
+// another, naming the nodes that were added and removed.
+func recordNodesUpdated(previous, nodes string) {
+	if recorder == nil {
+		return
+	}
+
+	added, removed, _ := discovery.Diff(previous, nodes)
+	recorder.Eventf(eventObject, corev1.EventTypeNormal, eventNodesUpdated,
+		"Nodes file now lists %d nodes (added: %s; removed: %s)", discovery.Count(nodes), listOrNone(added), listOrNone(removed))
+}
+
+// recordWriteFailed records an Event for the nodes file having failed to be written.
+func recordWriteFailed(err error) {
+	if recorder == nil {
+		return
+	}
+
+	recorder.Event(eventObject, corev1.EventTypeWarning, eventNodesWriteFailed, fmt.Sprintf("Failed to write nodes file: %v", err))
+}
+
+// listOrNone returns the given entries as a comma-separated list, or "none" if there aren't any.
+func listOrNone(entries []string) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+
+	return strings.Join(entries, ", ")
+}
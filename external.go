@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// serviceLookup returns the per-pod Service exposing the pod behind a node, or nil if there isn't
+// one.
+type serviceLookup func(n discovery.Endpoint) (*corev1.Service, error)
+
+// newExternalCache returns an informer caching the per-pod Services in the given namespace of the
+// given cluster, the informer factory that must be started for it to run, and a serviceLookup that
+// finds them in its cache.
+func newExternalCache(c cluster, ns string) (informers.SharedInformerFactory, cache.SharedIndexInformer, serviceLookup) {
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clients, resyncInterval,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(selectExternalServices),
+	)
+
+	svcs := factory.Core().V1().Services()
+	lister := svcs.Lister().Services(ns)
+
+	return factory, svcs.Informer(), func(n discovery.Endpoint) (*corev1.Service, error) {
+		items, err := lister.List(labels.SelectorFromSet(labels.Set{externalServiceLabel: n.Pod}))
+		if err != nil || len(items) == 0 {
+			return nil, err
+		}
+		return items[0], nil
+	}
+}
+
+// listServiceLookup returns a serviceLookup for the per-pod Services in each namespace of the given
+// clusters, as listed from their API servers, without going through an informer. Failing to list
+// the Services in a remote cluster only logs a warning, leaving its nodes with internal addresses.
+func listServiceLookup(ctx context.Context, clusters []cluster) (serviceLookup, error) {
+	options := metav1.ListOptions{}
+	selectExternalServices(&options)
+
+	byPod := make(map[string]*corev1.Service)
+	for _, c := range clusters {
+		for _, ns := range namespaces {
+			list, err := c.clients.CoreV1().Services(ns).List(ctx, options)
+			if err != nil {
+				if c.name == "" {
+					return nil, err
+				}
+
+				slog.Warn("failed to list services in remote cluster", "cluster", c.name, "namespace", ns, "error", err)
+				continue
+			}
+
+			for i := range list.Items {
+				svc := &list.Items[i]
+				byPod[path.Join(c.name, ns, svc.Labels[externalServiceLabel])] = svc
+			}
+		}
+	}
+
+	return func(n discovery.Endpoint) (*corev1.Service, error) {
+		return byPod[path.Join(n.Cluster, n.Namespace, n.Pod)], nil
+	}, nil
+}
+
+// selectExternalServices restricts list and watch requests to the per-pod Services, which are those
+// with the external service label.
+func selectExternalServices(options *metav1.ListOptions) {
+	options.LabelSelector = externalServiceLabel
+}
+
+// externalNodes returns the nodes with their pod addresses and ports replaced by those of the
+// per-pod Services exposing them, when the address source is external. A node is left with its pod
+// address, with a warning, if it has no such Service or the Service has no external address yet.
+func externalNodes(nodes []discovery.Endpoint, lookup serviceLookup) ([]discovery.Endpoint, error) {
+	if addressSource != "external" {
+		return nodes, nil
+	}
+
+	mapped := make([]discovery.Endpoint, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Pod == "" || n.Static {
+			mapped = append(mapped, n)
+			continue
+		}
+
+		svc, err := lookup(n)
+		if err != nil {
+			return nil, err
+		}
+
+		external, reason := externalEndpoint(n, svc)
+		if reason != "" {
+			slog.Warn("using internal address for node", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "reason", reason)
+			mapped = append(mapped, n)
+			continue
+		}
+
+		mapped = append(mapped, external)
+	}
+
+	return mapped, nil
+}
+
+// externalEndpoint returns the node as reached through the given per-pod Service. That's at its
+// first load balancer ingress, or failing that its first external IP, on the Service ports that
+// target the node's ports. If the node can't be reached through the Service, the reason is returned
+// instead.
+func externalEndpoint(n discovery.Endpoint, svc *corev1.Service) (discovery.Endpoint, string) {
+	if svc == nil {
+		return n, "no service labelled " + externalServiceLabel + "=" + n.Pod
+	}
+
+	var host string
+	if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) > 0 {
+		host = ingress[0].IP
+		if host == "" {
+			host = ingress[0].Hostname
+		}
+	} else if len(svc.Spec.ExternalIPs) > 0 {
+		host = svc.Spec.ExternalIPs[0]
+	}
+
+	if host == "" {
+		return n, "service " + svc.Name + " has no external address yet"
+	}
+
+	peer, api := servicePort(svc, n.PeerPort), servicePort(svc, n.APIPort)
+	if peer == 0 || api == 0 {
+		return n, "service " + svc.Name + " doesn't expose both the peering and API ports"
+	}
+
+	return discovery.Endpoint{
+		Cluster:   n.Cluster,
+		Namespace: n.Namespace,
+		Service:   n.Service,
+		IP:        host,
+		Pod:       n.Pod,
+		PeerPort:  peer,
+		APIPort:   api,
+	}, ""
+}
+
+// servicePort returns the port the Service exposes the given container port on, or zero if it
+// doesn't. Ports that target a named container port can't be matched.
+func servicePort(svc *corev1.Service, port int) int {
+	for _, p := range svc.Spec.Ports {
+		target := p.TargetPort.IntValue()
+		if target == 0 && p.TargetPort.StrVal == "" {
+			// An unset target port is the same as the service port.
+			target = int(p.Port)
+		}
+
+		if target == port {
+			return int(p.Port)
+		}
+	}
+
+	return 0
+}
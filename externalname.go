@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/client-go/kubernetes"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// externalName returns the external name of the given service in the given namespace, if it's an
+// ExternalName service, or empty otherwise. A service that doesn't exist, or that tsns isn't allowed
+// to get, is taken not to be one, so that watching endpoints doesn't need permission to get services.
+func externalName(ctx context.Context, clients kubernetes.Interface, ns, svc string) (string, error) {
+	s, err := clients.CoreV1().Services(ns).Get(ctx, svc, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if s.Spec.Type != corev1.ServiceTypeExternalName {
+		return "", nil
+	}
+
+	return s.Spec.ExternalName, nil
+}
+
+// newExternalNameSource returns a source for the given ExternalName service in the given namespace
+// of the given cluster, which resolves its external name through DNS. ExternalName services have no
+// endpoints to watch, so the source is always polled.
+func newExternalNameSource(c cluster, ns, svc, host string) *source {
+	src := &source{cluster: c.name, namespace: ns, service: svc, polling: true}
+	src.nodes = func() ([]discovery.Endpoint, error) { return src.polled, nil }
+	src.list = func(ctx context.Context) ([]discovery.Endpoint, error) {
+		nodes, err := resolveExternalName(ctx, ns, svc, host)
+		return inCluster(c.name, nodes), err
+	}
+
+	return src
+}
+
+// resolveExternalName returns the nodes at the addresses the given host, the external name of the
+// given service, resolves to, listed with -peer-port and -api-port. Unlike for a headless service,
+// the name not resolving is a failure, so that the nodes it last resolved to are kept.
+func resolveExternalName(ctx context.Context, ns, svc, host string) ([]discovery.Endpoint, error) {
+	ips, err := resolveIPs(ctx, host)
+	if err != nil {
+		externalNameFailuresTotal.WithLabelValues(ns, svc).Inc()
+		return nil, err
+	}
+
+	nodes := make([]discovery.Endpoint, 0, len(ips))
+	for _, ip := range ips {
+		nodes = append(nodes, discovery.Endpoint{Namespace: ns, Service: svc, IP: ip, PeerPort: peerPort, APIPort: apiPort})
+	}
+
+	return nodes, nil
+}
+
+// listExternalNameNodes returns the nodes of the given service, resolved from its external name, and
+// whether it is an ExternalName service at all.
+func listExternalNameNodes(ctx context.Context, clients kubernetes.Interface, ns, svc string) ([]discovery.Endpoint, bool, error) {
+	host, err := externalName(ctx, clients, ns, svc)
+	if err != nil || host == "" {
+		return nil, false, err
+	}
+
+	slog.Debug("resolving external name of service", "namespace", ns, "service", svc, "external_name", host)
+
+	nodes, err := resolveExternalName(ctx, ns, svc, host)
+	return nodes, true, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+
+	"k8s.io/utils/inotify"
+)
+
+// watchNodesFiles calls changed whenever any of the files at the given paths is created, written,
+// renamed or removed, by anything including tsns itself, until ctx is done. Their directories are
+// watched rather than the files, so that the watch carries on after a file is replaced by a rename,
+// as every write does.
+func watchNodesFiles(ctx context.Context, paths []string, changed func()) error {
+	w, err := inotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		files[filepath.Clean(path)] = true
+		dirs[filepath.Dir(path)] = true
+	}
+
+	flags := inotify.InCreate | inotify.InModify | inotify.InCloseWrite | inotify.InMovedFrom | inotify.InMovedTo | inotify.InDelete
+	for dir := range dirs {
+		if err := w.AddWatch(dir, flags); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer w.Close()
+
+		for {
+			select {
+			case e := <-w.Event:
+				if files[filepath.Clean(e.Name)] {
+					changed()
+				}
+			case err := <-w.Error:
+				slog.Warn("error watching nodes files", "files", paths, "error", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
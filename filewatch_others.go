@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchNodesFiles isn't supported outside Linux.
+func watchNodesFiles(ctx context.Context, paths []string, changed func()) error {
+	return errors.New("watching the nodes file is only supported on linux")
+}
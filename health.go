@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is how often the event loop reports that it's still running.
+const heartbeatInterval = 10 * time.Second
+
+// health tracks the state reported by the health endpoints.
+var health = healthState{tooFewNodes: -1, tooManyNodes: -1}
+
+// healthState holds what's needed to decide whether tsns is alive and ready.
+type healthState struct {
+	mu sync.Mutex
+
+	heartbeat time.Time
+	synced    bool
+	lastWrite time.Time
+	lastError error
+
+	// tooFewNodes is the number of nodes found when that's fewer than the minimum, or -1.
+	tooFewNodes int
+
+	// tooManyNodes is the number of nodes found when that's more than -max-nodes with
+	// -max-nodes-action=hold, or -1.
+	tooManyNodes int
+
+	// nodes is the node list last found, and written the node list last known to be in the nodes
+	// file. They differ while the nodes file can't be brought up to date.
+	nodes   string
+	written string
+
+	// selfError is the error the local Typesense process last failed its health check with, with
+	// -verify-self. selfChecked is whether it's been checked yet.
+	selfError   error
+	selfChecked bool
+
+	// raft is the local Typesense node's view of its raft cluster, with -raft-poll-interval.
+	raft *raftView
+
+	// degraded is the sources that couldn't be listed on the last reconcile that tried, as
+	// cluster/namespace/service, which are served from what was last found for them instead, and
+	// degradedSince when that started.
+	degraded      []string
+	degradedSince time.Time
+
+	// sinks holds the state of each of the sinks, the nodes files among them, by name.
+	sinks map[string]*sinkState
+}
+
+// sinkState holds the state of one of the sinks.
+type sinkState struct {
+	lastWrite time.Time
+	lastError error
+}
+
+// beat records that the event loop is still running.
+func (h *healthState) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.heartbeat = time.Now()
+}
+
+// setSynced records that the endpoints watch is established and its cache has synced.
+func (h *healthState) setSynced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.synced = true
+}
+
+// recordWrite records that the nodes file is up to date with the given node list, whether or not it
+// needed writing.
+func (h *healthState) recordWrite(nodes string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastWrite = time.Now()
+	h.lastError = nil
+	h.written = nodes
+}
+
+// recordSinkWrite records that the named sink was written.
+func (h *healthState) recordSinkWrite(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.sink(name)
+	s.lastWrite = time.Now()
+	s.lastError = nil
+}
+
+// recordSinkError records that the named sink couldn't be written.
+func (h *healthState) recordSinkError(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sink(name).lastError = err
+}
+
+// sink returns the state of the named sink. h.mu must be held.
+func (h *healthState) sink(name string) *sinkState {
+	if h.sinks == nil {
+		h.sinks = make(map[string]*sinkState)
+	}
+
+	s, ok := h.sinks[name]
+	if !ok {
+		s = &sinkState{}
+		h.sinks[name] = s
+	}
+
+	return s
+}
+
+// setSelfError records the result of the local Typesense process's health check.
+func (h *healthState) setSelfError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.selfError = err
+	h.selfChecked = true
+}
+
+// setRaft records the local Typesense node's view of its raft cluster.
+func (h *healthState) setRaft(view raftView) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.raft = &view
+}
+
+// setDegraded records the sources that couldn't be listed, if any, clearing the condition if there
+// aren't any. It returns true if that clears it.
+func (h *healthState) setDegraded(sources []string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	recovered := len(h.degraded) > 0 && len(sources) == 0
+	if len(h.degraded) == 0 && len(sources) > 0 {
+		h.degradedSince = time.Now()
+	}
+
+	h.degraded = sources
+	return recovered
+}
+
+// writtenNodes returns the node list last known to be in the nodes file.
+func (h *healthState) writtenNodes() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.written
+}
+
+// setNodes records the node list last found, whether or not it makes it into the nodes file.
+func (h *healthState) setNodes(nodes string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes = nodes
+}
+
+// recordError records that the nodes file couldn't be brought up to date.
+func (h *healthState) recordError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err
+}
+
+// setTooFewNodes records that the given number of nodes was found, which is fewer than the minimum,
+// so the nodes file wasn't updated. A negative count clears the condition.
+func (h *healthState) setTooFewNodes(count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tooFewNodes = count
+}
+
+// setTooManyNodes records that the given number of nodes was found, which is more than the maximum,
+// so the nodes file wasn't updated. A negative count clears the condition.
+func (h *healthState) setTooManyNodes(count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tooManyNodes = count
+}
+
+// live returns an error if the event loop has stopped reporting in.
+func (h *healthState) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A burst of events can hold the loop for up to the maximum debounce period.
+	timeout := 3*heartbeatInterval + debounceMax
+
+	if !h.heartbeat.IsZero() && time.Since(h.heartbeat) > timeout {
+		return fmt.Errorf("event loop hasn't reported in for %s", time.Since(h.heartbeat).Round(time.Second))
+	}
+
+	return nil
+}
+
+// ready returns the reasons tsns isn't ready, if any.
+func (h *healthState) ready() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var reasons []string
+
+	if !h.synced {
+		reasons = append(reasons, "endpoints watch not established")
+	}
+
+	// Only the leader writes the nodes file, so it can't be held against the others.
+	if !writing() {
+		if readyOnlyLeader {
+			reasons = append(reasons, "not the leader")
+		}
+	} else if h.lastWrite.IsZero() {
+		reasons = append(reasons, "nodes file not written yet")
+	} else if readyStaleness > 0 && time.Since(h.lastWrite) > readyStaleness {
+		reasons = append(reasons, fmt.Sprintf("nodes file last confirmed up to date %s ago", time.Since(h.lastWrite).Round(time.Second)))
+	}
+
+	if h.lastError != nil {
+		reasons = append(reasons, fmt.Sprintf("last update failed: %s", h.lastError))
+	}
+
+	if since := nodesSeen.since(); maxEmptyDuration > 0 && since > maxEmptyDuration {
+		reasons = append(reasons, fmt.Sprintf("no nodes discovered for %s", since.Round(time.Second)))
+	}
+
+	if h.tooFewNodes >= 0 {
+		reasons = append(reasons, fmt.Sprintf("found %d nodes, fewer than the minimum of %d", h.tooFewNodes, minNodes))
+	}
+
+	if h.tooManyNodes >= 0 {
+		reasons = append(reasons, fmt.Sprintf("found %d nodes, more than the maximum of %d", h.tooManyNodes, maxNodes))
+	}
+
+	return reasons
+}
+
+// healthResponse is the body returned by the health endpoints.
+type healthResponse struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// handleHealth registers the liveness and readiness endpoints on mux.
+func handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		var reasons []string
+		if err := health.live(); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+		writeHealth(w, reasons)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.ready())
+	})
+}
+
+// writeHealth writes a health response, failing it if there are any reasons given.
+func writeHealth(w http.ResponseWriter, reasons []string) {
+	response := healthResponse{Status: "ok", Reasons: reasons}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if len(reasons) > 0 {
+		response.Status = "failing"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+const (
+	// notifyAttempts is how many times the -notify-url request is made before giving up.
+	notifyAttempts = 3
+
+	// notifyBackoff is how long to wait before retrying the -notify-url request the first time. The
+	// wait doubles for each retry after that.
+	notifyBackoff = 500 * time.Millisecond
+
+	// notifyTimeout is how long to wait for a response to each -notify-url request.
+	notifyTimeout = 5 * time.Second
+)
+
+// hookRun is a run of the hooks for a node list that's just been written, for the given reason.
+type hookRun struct {
+	nodes  string
+	reason string
+}
+
+// hookRunner runs the hooks after each write of the nodes file in the background, so that a slow
+// hook can't hold up the event loop, and with it endpoint events and the heartbeat that /livez
+// checks. Only one run is made at a time. Runs queued while one is underway are coalesced, so that
+// only the latest node list is run for once it's done.
+type hookRunner struct {
+	pending chan hookRun
+}
+
+// newHookRunner returns a hookRunner, running hooks until ctx is done.
+func newHookRunner(ctx context.Context) *hookRunner {
+	r := &hookRunner{pending: make(chan hookRun, 1)}
+	go r.run(ctx)
+	return r
+}
+
+// queue queues a run of the hooks for the given node list, replacing any run still waiting.
+func (r *hookRunner) queue(nodes, reason string) {
+	select {
+	case <-r.pending:
+	default:
+	}
+	r.pending <- hookRun{nodes: nodes, reason: reason}
+}
+
+// run makes queued runs until ctx is done.
+func (r *hookRunner) run(ctx context.Context) {
+	for {
+		select {
+		case h := <-r.pending:
+			runHooks(ctx, h.nodes, h.reason)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runHooks runs the hooks for a node list that's just been written, for the given reason: the
+// post-update command, then the -notify-url request, then signalling the Typesense process.
+func runHooks(ctx context.Context, nodes, reason string) {
+	runPostUpdateCmd(ctx, nodes, reason)
+	notifyTypesense(ctx)
+	signalTypesense()
+}
+
+// runPostUpdateCmd runs the -post-update-cmd command, if there is one, after the nodes file has been
+// written with the given node list. The command is run by the shell, with the node list on stdin.
+// Its output is logged, and failing or timing out only logs a warning.
+func runPostUpdateCmd(ctx context.Context, nodes, reason string) {
+	if postUpdateCmd == "" || dryRun {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, postUpdateTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", postUpdateCmd)
+	cmd.Stdin = strings.NewReader(nodes)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Children of the shell can keep its output open after it's been killed, so don't wait long
+	// for them.
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"TSNS_NODES="+nodes,
+		"TSNS_NODE_COUNT="+strconv.Itoa(discovery.Count(nodes)),
+		"TSNS_NODES_FILE="+strings.Join(nodesFiles, ","),
+		"TSNS_REASON="+reason,
+	)
+
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+
+	attrs := []any{"command", postUpdateCmd, "duration", duration, "stdout", strings.TrimSpace(stdout.String()), "stderr", strings.TrimSpace(stderr.String())}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		slog.Warn("post-update command timed out", append(attrs, "timeout", postUpdateTimeout)...)
+	case errors.As(err, &exitErr):
+		slog.Warn("post-update command failed", append(attrs, "exit_code", exitErr.ExitCode())...)
+	case err != nil:
+		slog.Warn("failed to run post-update command", append(attrs, "error", err)...)
+	default:
+		slog.Info("ran post-update command", attrs...)
+	}
+}
+
+// notifyTypesense makes the -notify-url request, if there is one, after the nodes file has been
+// written, so that the local Typesense process can act on the change without waiting to re-read
+// the file. If TYPESENSE_API_KEY is set it's sent as the API key. Failed requests are retried a
+// few times, backing off between them, then only logged.
+func notifyTypesense(ctx context.Context) {
+	if notifyURL == "" || dryRun {
+		return
+	}
+
+	backoff := notifyBackoff
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := notifyRequest(ctx)
+		duration := time.Since(start)
+
+		notifyDuration.Observe(duration.Seconds())
+
+		if err == nil {
+			notifyRequestsTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+			slog.Info("notified typesense", "url", notifyURL, "status", status, "duration", duration)
+			return
+		}
+
+		result := "error"
+		if status != 0 {
+			result = strconv.Itoa(status)
+		}
+		notifyRequestsTotal.WithLabelValues(result).Inc()
+
+		if attempt == notifyAttempts || ctx.Err() != nil {
+			slog.Warn("failed to notify typesense", "url", notifyURL, "attempts", attempt, "duration", duration, "error", err)
+			return
+		}
+
+		slog.Debug("failed to notify typesense, retrying", "url", notifyURL, "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+// signalTypesense sends -signal to the local Typesense process, if -signal-process or
+// -signal-pid-file is set, after the nodes file has been written, so that it re-reads the file
+// straight away. That needs the pod to share its process namespace. The process not running, as when
+// its container is crash looping, only logs a warning.
+func signalTypesense() {
+	if processSignal == nil || dryRun {
+		return
+	}
+
+	pids, err := typesensePIDs()
+	if err != nil {
+		slog.Warn("failed to find typesense process to signal", "process", signalProcess, "pid_file", signalPIDFile, "error", err)
+		return
+	}
+	if len(pids) == 0 {
+		slog.Warn("no typesense process found to signal", "process", signalProcess, "pid_file", signalPIDFile)
+		return
+	}
+
+	for _, pid := range pids {
+		p, err := os.FindProcess(pid)
+		if err == nil {
+			err = p.Signal(processSignal)
+		}
+		if err != nil {
+			slog.Warn("failed to signal typesense", "pid", pid, "signal", processSignal, "error", err)
+			continue
+		}
+
+		slog.Info("signalled typesense", "pid", pid, "signal", processSignal)
+	}
+}
+
+// typesensePIDs returns the PID in -signal-pid-file, if it's set, or else the PIDs of the processes
+// named -signal-process. A PID file that doesn't exist gives no PIDs.
+func typesensePIDs() ([]int, error) {
+	if signalPIDFile == "" {
+		return findProcesses(signalProcess)
+	}
+
+	b, err := os.ReadFile(signalPIDFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("invalid PID in %s: %q", signalPIDFile, strings.TrimSpace(string(b)))
+	}
+
+	return []int{pid}, nil
+}
+
+// notifyRequest makes a single -notify-url request, returning the response status, if there was
+// one. Any status other than 2xx is an error.
+func notifyRequest(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, notifyMethod, notifyURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if key := os.Getenv("TYPESENSE_API_KEY"); key != "" {
+		req.Header.Set("X-Typesense-Api-Key", key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,208 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// startAPIServer starts a kube-apiserver and etcd for the rest of the test, from the binaries in
+// KUBEBUILDER_ASSETS, and returns clients for it with the typesense namespace and ts service created.
+func startAPIServer(ctx context.Context, t *testing.T) kubernetes.Interface {
+	t.Helper()
+
+	env := &envtest.Environment{}
+	config, err := env.Start()
+	if err != nil {
+		t.Fatalf("failed to start the API server, is KUBEBUILDER_ASSETS set? %v", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("failed to stop the API server: %v", err)
+		}
+	})
+
+	clients, err := newClients(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clients.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "typesense"}}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clients.CoreV1().Services("typesense").Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  map[string]string{"app": "ts"},
+			Ports:     []corev1.ServicePort{{Name: "http", Port: 8108}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clients
+}
+
+// updateEndpoints replaces the Endpoints of the ts service with e, and waits for src to see as many
+// nodes as e has ready addresses.
+func updateEndpoints(ctx context.Context, t *testing.T, clients kubernetes.Interface, src *source, e *corev1.Endpoints) {
+	t.Helper()
+	if _, err := clients.CoreV1().Endpoints("typesense").Update(ctx, e, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the update", func() bool { return sourceNodes(t, src) == len(e.Subsets[0].Addresses) })
+}
+
+func TestIntegrationEndpoints(t *testing.T) {
+	path := setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := startAPIServer(ctx, t)
+	if _, err := clients.CoreV1().Endpoints("typesense").Create(ctx, tsEndpoints("10.0.0.2", "10.0.0.1"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+
+	r.reconcile(ctx, reasonStartup, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file after startup = %q, want %q", got, want)
+	}
+
+	updateEndpoints(ctx, t, clients, src, tsEndpoints("10.0.0.2", "10.0.0.1", "10.0.0.3"))
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108,10.0.0.3:8107:8108"; got != want {
+		t.Fatalf("nodes file after adding an address = %q, want %q", got, want)
+	}
+
+	updateEndpoints(ctx, t, clients, src, tsEndpoints("10.0.0.3", "10.0.0.2"))
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "10.0.0.2:8107:8108,10.0.0.3:8107:8108"; got != want {
+		t.Fatalf("nodes file after removing an address = %q, want %q", got, want)
+	}
+
+	// With -min-nodes at zero, the node list is emptied when the Endpoints go away.
+	if err := clients.CoreV1().Endpoints("typesense").Delete(ctx, "ts", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delete", func() bool { return sourceNodes(t, src) == 0 })
+
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), ""; got != want {
+		t.Fatalf("nodes file after delete = %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationBootstrap(t *testing.T) {
+	path := setupNodesFile(t)
+	set(t, &bootstrapFromStatefulSet, true)
+	set(t, &bootstrapStatefulSet, "ts")
+	set(t, &bootstrapHandover, 1)
+	set(t, &bootstrapTimeout, 0)
+	set(t, &clusterDomain, "cluster.local")
+	set(t, &peerPort, 8107)
+	set(t, &apiPort, 8108)
+	setBootstrapping(false)
+	t.Cleanup(func() { setBootstrapping(false) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// No controllers run against the API server, so the StatefulSet never gets any pods, and the
+	// Endpoints only change when the test changes them.
+	clients := startAPIServer(ctx, t)
+	labels := map[string]string{"app": "ts"}
+	_, err := clients.AppsV1().StatefulSets("typesense").Create(ctx, &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    pointer.Int32(3),
+			ServiceName: "ts",
+			Selector:    &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "typesense", Image: "typesense/typesense"}}},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients.CoreV1().Endpoints("typesense").Create(ctx, tsEndpoints(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bootstrapStatefulSetName(ctx, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory, informer, get := newStatefulSetCache(clients, name)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		t.Fatal("statefulset cache didn't sync")
+	}
+
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+	r.getStatefulSet = get
+
+	// With no ready addresses, the nodes are predicted from the StatefulSet.
+	r.reconcile(ctx, reasonStartup, 0)
+	if got, want := readNodesFile(t, path), "ts-0.ts.typesense.svc.cluster.local:8107:8108,ts-1.ts.typesense.svc.cluster.local:8107:8108,ts-2.ts.typesense.svc.cluster.local:8107:8108"; got != want {
+		t.Fatalf("nodes file at startup = %q, want %q", got, want)
+	}
+	if !bootstrapping.Load() {
+		t.Fatal("not bootstrapping with no nodes discovered")
+	}
+
+	// The predicted nodes follow the StatefulSet when it's scaled.
+	sts, err := clients.AppsV1().StatefulSets("typesense").Get(ctx, "ts", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sts.Spec.Replicas = pointer.Int32(2)
+	if _, err := clients.AppsV1().StatefulSets("typesense").Update(ctx, sts, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the scale down", func() bool {
+		sts, err := get()
+		return err == nil && sts != nil && *sts.Spec.Replicas == 2
+	})
+
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "ts-0.ts.typesense.svc.cluster.local:8107:8108,ts-1.ts.typesense.svc.cluster.local:8107:8108"; got != want {
+		t.Fatalf("nodes file after scaling down = %q, want %q", got, want)
+	}
+
+	// One of the two predicted nodes discovered isn't enough to hand over.
+	updateEndpoints(ctx, t, clients, src, tsEndpoints("10.0.0.1"))
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "ts-0.ts.typesense.svc.cluster.local:8107:8108,ts-1.ts.typesense.svc.cluster.local:8107:8108"; got != want {
+		t.Fatalf("nodes file with one node discovered = %q, want %q", got, want)
+	}
+
+	updateEndpoints(ctx, t, clients, src, tsEndpoints("10.0.0.2", "10.0.0.1"))
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file with both nodes discovered = %q, want %q", got, want)
+	}
+	if bootstrapping.Load() {
+		t.Error("still bootstrapping with enough nodes discovered")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The timings of the leader election, which are the usual ones for Kubernetes controllers.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leading reports whether this replica currently holds the leader lease. It's only meaningful with
+// -leader-elect.
+var leading atomic.Bool
+
+// writing reports whether this replica should write the node list, which it should unless leader
+// election is enabled and another replica is the leader.
+func writing() bool {
+	return !leaderElect || leading.Load()
+}
+
+// runLeaderElection takes part in leader election using a Lease named by -leader-elect-lease-name in
+// the first namespace, until ctx is done. Whenever this replica becomes the leader, elected is
+// called. Losing the lease doesn't stop the replica, which keeps its caches warm and stands for
+// election again.
+func runLeaderElection(ctx context.Context, clients kubernetes.Interface, elected func()) error {
+	// Outside a pod, or where its name isn't known, the hostname is still unique enough an identity.
+	identity := podName
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	if identity == "" {
+		return errors.New("failed to determine leader election identity, as -pod-name isn't set and the hostname isn't available")
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaderElectLeaseName, Namespace: namespaces[0]},
+		Client:     clients.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            leaderElectLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				slog.Info("became the leader", "lease", lock.Describe(), "identity", identity)
+				leading.Store(true)
+				elected()
+			},
+			OnStoppedLeading: func() {
+				if leading.Swap(false) {
+					slog.Warn("stopped being the leader", "lease", lock.Describe(), "identity", identity)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					slog.Info("following the leader", "lease", lock.Describe(), "leader", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election: %w", err)
+	}
+
+	go func() {
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+
+	return nil
+}
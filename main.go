@@ -1,93 +1,1858 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+	"github.com/seeruk/tsns/pkg/sink"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-var namespace, service, nodesFile string
+// The reasons the nodes file may be written for.
+const (
+	reasonStartup   = "startup"
+	reasonEndpoints = "endpoint event"
+	reasonResync    = "resync"
+	reasonOnce      = "once"
+	reasonRetry     = "write retry"
+	reasonLeader    = "became leader"
+	reasonReconcile = "periodic reconcile"
+	reasonBootstrap = "bootstrap timeout"
+	reasonNodesFile = "nodes file changed"
+	reasonHeld      = "min write interval"
+	reasonPoll      = "poll"
+	reasonConfig    = "config changed"
+	reasonRecovered = "api server recovered"
+	reasonOperator  = "operator triggered"
+	reasonStateFile = "state file"
+)
+
+var configFile, kubeconfig, kubeContext, namespace, service, healthAddr, metricsAddr, pprofAddr, outputConfigMap, postUpdateCmd string
+var notifyURL, notifyMethod, webhookURL, webhookSecretEnv, leaderElectLeaseName, extraNodes, extraNodesEnv string
+var signalProcess, signalPIDFile, signalName string
+
+// processSignal is the parsed -signal, or nil if the Typesense process isn't signalled.
+var processSignal os.Signal
+var apiPortName, peerPortName string
 var apiPort, peerPort int
+var nodesFileMode os.FileMode
+var nodesFileUID, nodesFileGID int
+var ipFamily, addressSource, externalServiceLabel string
+var useEndpointSlices, useHostnames, publishedHostnamesOnly, hostnamesFromPods, once, dryRun, verifyPeers, includeNotReady bool
+var leaderElect, readyOnlyLeader, recordEvents, bootstrapFromStatefulSet, excludeTerminating, requireContainerReady bool
+var waitQuorum, watchNodes, noFsync, verifySelfHealth, verifyPeerPort, kubeProtobuf, skipPreflight, sameZoneOnly bool
+var zoneOverride, nodeSelector, podName, podNamespace, stateAnnotation string
+var minNodes, maxNodes, expectedNodes, includeNotReadyBelow, writeAttempts, webhookAttempts int
+var maxNodesAction, sortBy string
+var minNodesOverrideAfter, verifyPeersTimeout, verifyPeerPortTimeout, minWriteInterval, pollInterval time.Duration
+var waitForQuorumTimeout, raftPollInterval, raftDisagreementAfter, maxEmptyDuration, exitOnEmptyAfter time.Duration
+var resyncInterval, debounce, debounceMax, shutdownGrace, readyStaleness, postUpdateTimeout, webhookTimeout time.Duration
+var apiTimeout, writeRetryInterval, writeRetryAfter, startupTimeout, reconcileInterval, bootstrapTimeout, terminatingGrace time.Duration
+var bootstrapHandover float64
+var selector, excludeAnnotation, peerPortAnnotation, apiPortAnnotation, bootstrapStatefulSet, bootstrapTimeoutAction string
+var selectorIncludeUnknown bool
+var logLevel, logFormat string
+var nodesFormat, formatTemplate, jsonFile, stateFile string
+var discoveryMode, typesenseContainer, verifySelfAction, verifyPeerPortAction, clusterDomain string
+var debug bool
+
+// namespaces and services hold the names given by the -namespace and -service flags. Every service
+// is looked for in every namespace.
+var namespaces, services []string
+
+// nodesFiles holds the paths given by the -nodes-file flag, which are each written with the same
+// node list.
+var nodesFiles []string
+
+// staticNodes holds the nodes given by the -extra-nodes flag.
+var staticNodes []discovery.Endpoint
+
+// nodeOptions controls how endpoints are converted into nodes, and nodesTargets are the sinks the
+// node list is written to, the nodes files first. Both are set up from the flags by run.
+var nodeOptions discovery.Options
+var nodesTargets []*nodesTarget
+
+// lastNodes holds the canonical form of the node list most recently written to any of the nodes
+// files.
+var lastNodes string
+
+// nodesFileChanged is set when the nodes file is seen to change, so that the next reconcile checks
+// it against what was last written.
+var nodesFileChanged atomic.Bool
+
+// nodesTemplate is the template the nodes file is written with, given by the -format and
+// -format-template flags, or nil if it's written in the Typesense or JSON format.
+var nodesTemplate *template.Template
 
 func main() {
-	flag.StringVar(&namespace, "namespace", "typesense", "The namespace that Typesense is installed within")
-	flag.StringVar(&service, "service", "ts", "The name of the Typesense service to use the endpoints of")
-	flag.StringVar(&nodesFile, "nodes-file", "/usr/share/typesense/nodes", "The location of the file to write node information to")
+	flag.StringVar(&configFile, "config", "", "A YAML file of settings to use for any flags not given, mapping flag names to values or lists of values, e.g. min-nodes: 3. It's checked for changes every 10s, and some settings applied straight away (disabled if empty)")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "The kubeconfig to use, instead of $KUBECONFIG, ~/.kube/config or the in-cluster config")
+	flag.BoolVar(&kubeProtobuf, "kube-protobuf", true, "Ask the Kubernetes API server for protobuf rather than JSON, which is cheaper to decode, falling back to JSON where it isn't supported")
+	flag.StringVar(&kubeContext, "kube-context", "", "The kubeconfig context to use, instead of the current context")
+	flag.Func("remote-kubeconfig", "The kubeconfig of a further cluster to discover nodes in, as path[:context], or a comma-separated list of them. May be repeated", func(value string) error {
+		remoteKubeconfigs = append(remoteKubeconfigs, splitList(value)...)
+		return nil
+	})
+	flag.BoolVar(&skipPreflight, "skip-preflight", false, "Skip checking at startup that the namespaces and services exist and that tsns has permission to get, list and watch endpoints in them")
+	flag.StringVar(&namespace, "namespace", "typesense", "The namespace that Typesense is installed within, or a comma-separated list of namespaces to list the nodes of together")
+	flag.StringVar(&service, "service", "ts", "The name of the Typesense service to use the endpoints of, or a comma-separated list of services to list the nodes of together")
+	flag.Func("nodes-file", "The location of the file to write node information to, or a comma-separated list of locations to write the same node information to. May be repeated (default /usr/share/typesense/nodes)", func(value string) error {
+		nodesFiles = append(nodesFiles, splitList(value)...)
+		return nil
+	})
+	flag.Func("nodes-file-mode", "The octal file mode to give the nodes file, e.g. 0640 (default 0666 less the umask). With a pod fsGroup the file is already owned by that group, so a group-readable mode is enough for Typesense to read it", func(value string) error {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return fmt.Errorf("invalid file mode %q", value)
+		}
+		nodesFileMode = os.FileMode(mode)
+		return nil
+	})
+	flag.IntVar(&nodesFileUID, "nodes-file-uid", -1, "The user ID to give ownership of the nodes file to, or -1 to leave it unchanged")
+	flag.IntVar(&nodesFileGID, "nodes-file-gid", -1, "The group ID to give ownership of the nodes file to, or -1 to leave it unchanged. Not needed when the pod's fsGroup is the group Typesense runs as")
+	flag.BoolVar(&watchNodes, "watch-nodes-file", true, "Watch the nodes file, and write it again straight away if it's removed or changed by something else. Disable if another process also manages the file")
+	flag.IntVar(&writeAttempts, "write-attempts", 3, "How many times to try writing the nodes file before giving up until -write-retry-after")
+	flag.DurationVar(&writeRetryInterval, "write-retry-interval", 500*time.Millisecond, "How long to wait before retrying a failed write of the nodes file, doubling for each further attempt")
+	flag.DurationVar(&writeRetryAfter, "write-retry-after", 30*time.Second, "How long to wait before trying to write the nodes file again once -write-attempts have failed, if nothing else changes first")
+	flag.BoolVar(&noFsync, "no-fsync", false, "Don't sync the nodes file and its directory to disk after each write, e.g. when it's on a tmpfs emptyDir where that's pointless")
+	flag.StringVar(&outputConfigMap, "output-configmap", "", "The name of a ConfigMap to also publish the node list to, in the first namespace unless given as namespace/name. Requires permission to get, create and update it")
+	flag.StringVar(&postUpdateCmd, "post-update-cmd", "", "A shell command to run after each write of the nodes file, given the node list on stdin and in $TSNS_NODES, along with $TSNS_NODE_COUNT, $TSNS_NODES_FILE and $TSNS_REASON")
+	flag.DurationVar(&postUpdateTimeout, "post-update-timeout", 10*time.Second, "How long to let -post-update-cmd run for before killing it")
+	flag.StringVar(&notifyURL, "notify-url", "", "A URL to make a request to after each write of the nodes file, e.g. to have the local Typesense process pick up the change, sending $TYPESENSE_API_KEY if set")
+	flag.StringVar(&notifyMethod, "notify-method", http.MethodGet, "The HTTP method to use for -notify-url requests")
+	flag.StringVar(&webhookURL, "webhook-url", "", "A URL to POST the node list to as a JSON document, as with -json-file, whenever it changes. Deliveries are made in the background and retried, so they never hold up the nodes file, and a node list that still can't be delivered is tried again every -write-retry-after until it is. Its generation counts the node lists since tsns started (disabled if empty)")
+	flag.Func("webhook-header", "A header to send with each -webhook-url request, as Name: value, e.g. for an auth token. May be repeated", parseWebhookHeader)
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 10*time.Second, "How long to wait for a response to each -webhook-url request")
+	flag.IntVar(&webhookAttempts, "webhook-attempts", 5, "How many times to try delivering each node list to the -webhook-url before giving up, backing off between attempts")
+	flag.StringVar(&webhookSecretEnv, "webhook-secret-env", "", "An environment variable holding a shared secret to sign -webhook-url requests with, as the hex HMAC-SHA256 of the body in the X-Tsns-Signature header, prefixed with sha256= (unsigned if empty)")
+	flag.StringVar(&signalProcess, "signal-process", "", "The command name of a process to send -signal to after each write of the nodes file, e.g. typesense-server, found through /proc. Needs shareProcessNamespace on the pod. Can be used alongside -notify-url")
+	flag.StringVar(&signalPIDFile, "signal-pid-file", "", "A file holding the PID of the process to send -signal to after each write of the nodes file, instead of finding it by -signal-process")
+	flag.StringVar(&signalName, "signal", "HUP", "The signal to send with -signal-process or -signal-pid-file")
 	flag.IntVar(&apiPort, "api-port", 8108, "The port used by Typesense for peering")
 	flag.IntVar(&peerPort, "peer-port", 8107, "The port used by Typesense for peering")
+	flag.StringVar(&extraNodes, "extra-nodes", "", "A comma-separated list of host:peer:api entries for nodes outside Kubernetes to always list alongside those discovered, or file:/path/to/list to read them from a file, one or more to a line, which is read again on SIGHUP (default the value of the variable named by -extra-nodes-env)")
+	flag.StringVar(&extraNodesEnv, "extra-nodes-env", "EXTRA_NODES", "The environment variable to read -extra-nodes from when it isn't given, in any of its forms (none if empty)")
+	flag.StringVar(&apiPortName, "api-port-name", "", "The name of the service port to take the API port from, falling back to -api-port")
+	flag.StringVar(&peerPortName, "peer-port-name", "", "The name of the service port to take the peering port from, falling back to -peer-port")
+	flag.BoolVar(&excludeTerminating, "exclude-terminating", false, "Leave nodes whose pods are terminating out of the node list, as is always done with -discovery-mode=pods. Requires permission to list and watch pods")
+	flag.DurationVar(&terminatingGrace, "terminating-grace", 0, "How long a pod may be terminating for before its node is left out of the node list")
+	flag.StringVar(&peerPortAnnotation, "peer-port-annotation", "", "A pod annotation that overrides the peering port to list the pod's node with, e.g. tsns.tigrisdata.dev/peer-port (disabled if empty). Requires permission to list and watch pods")
+	flag.StringVar(&apiPortAnnotation, "api-port-annotation", "", "A pod annotation that overrides the API port to list the pod's node with, e.g. tsns.tigrisdata.dev/api-port (disabled if empty). Requires permission to list and watch pods")
+	flag.StringVar(&nodesFormat, "format", "typesense", "The format to write the nodes file in: typesense for host:peer:api entries separated by commas, newline for the same entries on separate lines, hosts-only for just the hosts on separate lines, or json for a JSON document listing the nodes")
+	flag.StringVar(&stateFile, "state-file", "", "A file to save the nodes last written in, along with the details needed to use them without the API server, e.g. /usr/share/typesense/tsns-state.json. If the nodes files are missing at startup they're written from it, and sources that can't be listed at first start from the nodes saved for them (disabled if empty)")
+	flag.StringVar(&jsonFile, "json-file", "", "A file to also write the nodes to as a JSON document, as with -format=json, whatever the nodes file's format (disabled if empty)")
+	flag.StringVar(&formatTemplate, "format-template", "", "A Go text/template to write the nodes file with, instead of -format. It's given a list of nodes with Host, IP, Hostname, PeerPort, APIPort and Entry (host:peer:api) fields")
+	flag.StringVar(&ipFamily, "ip-family", "ipv4", "The IP family (ipv4 or ipv6) to list nodes with when endpoints have addresses in both")
+	flag.StringVar(&addressSource, "address-source", "internal", "Where to take node addresses from: internal for pod IPs, or external for the load balancer addresses of per-pod Services. Requires permission to list and watch Services")
+	flag.StringVar(&externalServiceLabel, "external-service-label", "tsns.tigrisdata.dev/pod", "With -address-source=external, the label giving the name of the pod a per-pod Service exposes")
+	flag.StringVar(&discoveryMode, "discovery-mode", "endpoints", "What to discover nodes from: endpoints for the services' endpoints, pods for every running pod matching the services' selectors whether ready or not, or dns for the DNS records of headless services, polled every -poll-interval, without using the Kubernetes API at all. Pods mode requires permission to get services and list and watch pods")
+	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local", "The cluster's DNS domain, that services and pods have DNS names under")
+	flag.StringVar(&typesenseContainer, "typesense-container", "typesense", "With -discovery-mode=pods, the container that must have started for a pod to be listed (any running pod if empty). Also the container checked by -require-container-ready")
+	flag.BoolVar(&requireContainerReady, "require-container-ready", false, "Leave nodes out of the node list unless their pod's -typesense-container is ready and not crash looping, even if the pod as a whole is. Requires permission to list and watch pods")
+	flag.BoolVar(&useEndpointSlices, "use-endpointslices", false, "Discover nodes from discovery.k8s.io/v1 EndpointSlices instead of Endpoints")
+	flag.BoolVar(&useHostnames, "use-hostnames", false, "List nodes by their stable pod DNS names instead of their pod IPs, where the pod is known")
+	flag.BoolVar(&publishedHostnamesOnly, "published-hostnames-only", false, "With -use-hostnames, only list nodes by the hostnames their endpoints give them, which have DNS records under the service, and by their pod IPs otherwise, rather than falling back to their pod names")
+	flag.StringVar(&podName, "pod-name", "", "The name of this sidecar's own pod, e.g. from the downward API. Defaults to $POD_NAME, or else, when running in a pod, the hostname, as long as a pod of that name is found")
+	flag.StringVar(&podNamespace, "pod-namespace", "", "The namespace of this sidecar's own pod. Defaults to $POD_NAMESPACE, or else the namespace of its service account")
+	flag.BoolVar(&sameZoneOnly, "same-zone-only", false, "Only list nodes in the same zone as this sidecar's pod, by the topology.kubernetes.io/zone label of the Kubernetes nodes they're on, for a cluster per zone behind one service. Needs -pod-name, unless -zone is set, and permission to get pods and list and watch nodes")
+	flag.StringVar(&nodeSelector, "node-selector", "", "A label selector the Kubernetes nodes that the pods behind endpoints run on must match for them to be listed, e.g. pool=storage. Requires permission to list and watch nodes")
+	flag.StringVar(&zoneOverride, "zone", "", "With -same-zone-only, the zone to list nodes in, instead of the zone of this sidecar's Kubernetes node")
+	flag.BoolVar(&hostnamesFromPods, "hostnames-from-pods", false, "List nodes by the DNS names given by their pods' hostname and subdomain, even where the subdomain isn't the service, and by their pod IPs where that isn't set or the pod can't be found. Implies -use-hostnames. Requires permission to list and watch pods")
+	flag.BoolVar(&includeNotReady, "include-not-ready", false, "Also list nodes whose endpoints aren't ready yet")
+	flag.IntVar(&includeNotReadyBelow, "include-not-ready-below", 0, "With -include-not-ready, only list not ready nodes while fewer than this many distinct nodes are ready, across all the services (always if zero)")
+	flag.StringVar(&selector, "selector", "", "A label selector the pods behind endpoints must match to be listed as nodes, e.g. role!=analytics. Requires permission to list and watch pods")
+	flag.StringVar(&stateAnnotation, "state-annotation", "", "An annotation on this sidecar's own pod to record a hash and count of the node list in after each write, and to restore when it was written and whether bootstrapping from after a restart, e.g. tsns.tigrisdata.dev/last-nodes (disabled if empty). Requires permission to get and patch its pod")
+	flag.StringVar(&excludeAnnotation, "exclude-annotation", "", "An annotation that leaves a pod out of the node list when set to true, e.g. tsns.tigrisdata.dev/exclude (disabled if empty). Requires permission to list and watch pods")
+	flag.BoolVar(&selectorIncludeUnknown, "selector-include-unknown", false, "With -selector, also list nodes whose endpoints don't refer to a pod")
+	flag.BoolVar(&bootstrapFromStatefulSet, "bootstrap-from-statefulset", false, "While no nodes are found, list the pods a StatefulSet will have by their stable DNS names instead. Requires permission to get, list and watch StatefulSets")
+	flag.Float64Var(&bootstrapHandover, "bootstrap-handover", 1, "With -bootstrap-from-statefulset, the fraction of the StatefulSet's pods that must be discovered before the discovered nodes replace the predicted ones")
+	flag.DurationVar(&bootstrapTimeout, "bootstrap-timeout", 10*time.Minute, "With -bootstrap-from-statefulset, how long to keep listing the predicted nodes while too few are discovered, before handing over to those that are, or taking -bootstrap-timeout-action if there are none (forever if zero)")
+	flag.StringVar(&bootstrapTimeoutAction, "bootstrap-timeout-action", "keep", "What to do if no nodes have been discovered by -bootstrap-timeout and none of the predicted ones can be reached: keep to keep listing them, or exit to exit with an error")
+	flag.StringVar(&bootstrapStatefulSet, "bootstrap-statefulset", "", "With -bootstrap-from-statefulset, the StatefulSet to list the pods of, instead of the one owning this pod (given by -pod-name), which requires permission to get pods")
+	flag.BoolVar(&verifyPeers, "verify-peers", false, "Only list nodes whose Typesense /health endpoint reports them as healthy. This pod's own node, the one for -pod-name, is checked at 127.0.0.1")
+	flag.BoolVar(&waitQuorum, "wait-for-quorum", false, "Instead of writing the nodes file, wait until a majority of the expected nodes pass their /health check, then exit, or exit with an error after -wait-for-quorum-timeout. For holding back dependent workloads from an initContainer until the cluster has formed")
+	flag.IntVar(&expectedNodes, "expected-nodes", 0, "The number of nodes the cluster is expected to have, with -wait-for-quorum (the replicas of the StatefulSet given by -bootstrap-statefulset, or owning this pod, if zero)")
+	flag.DurationVar(&waitForQuorumTimeout, "wait-for-quorum-timeout", 10*time.Minute, "How long to wait for quorum before exiting with an error, with -wait-for-quorum (no limit if zero)")
+	flag.BoolVar(&verifyPeerPort, "verify-peer-port", false, "Dial each node's peering port on each reconcile, and act on those that can't be reached as given by -verify-peer-port-action. This pod's own node, the one for -pod-name, is dialled at 127.0.0.1")
+	flag.StringVar(&verifyPeerPortAction, "verify-peer-port-action", "omit", "What to do with nodes whose peering port can't be reached, with -verify-peer-port: omit to leave them out of the node list, or report to only report them in the logs and metrics")
+	flag.DurationVar(&verifyPeerPortTimeout, "verify-peer-port-timeout", time.Second, "How long to wait for each node's peering port to accept a connection, with -verify-peer-port")
+	flag.BoolVar(&verifySelfHealth, "verify-self", false, "Check the local Typesense process's /health endpoint, at 127.0.0.1 on -api-port, on each reconcile, and act on it as given by -verify-self-action. Requires -pod-name")
+	flag.StringVar(&verifySelfAction, "verify-self-action", "omit", "What to do when the local Typesense process fails its health check, with -verify-self: omit to leave this pod's own node out of the node list, or report to only report it in /status and metrics")
+	flag.DurationVar(&raftPollInterval, "raft-poll-interval", 0, "How often to check the local Typesense node's raft state at its /debug endpoint, at 127.0.0.1 on -api-port, sending $TYPESENSE_API_KEY if set, to report it in /status and metrics (disabled if 0)")
+	flag.DurationVar(&raftDisagreementAfter, "raft-disagreement-after", 5*time.Minute, "How long the local Typesense node may be neither leader nor follower, while the nodes file lists other nodes, before a warning is logged, with -raft-poll-interval")
+	flag.DurationVar(&verifyPeersTimeout, "verify-peers-timeout", 2*time.Second, "How long to wait for each node's /health endpoint to respond, with -verify-peers")
+	flag.BoolVar(&recordEvents, "events", false, "Record Kubernetes Events on this pod (given by -pod-name and -pod-namespace) or else the first service when the nodes file changes or can't be written. Requires permission to create events")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Only write the node list while holding a leader Lease in the first namespace, for replicas sharing one nodes file. Requires permission to get, create and update Leases")
+	flag.StringVar(&leaderElectLeaseName, "leader-elect-lease-name", "tsns", "The name of the Lease to use with -leader-elect")
+	flag.BoolVar(&readyOnlyLeader, "ready-only-leader", false, "With -leader-elect, report not ready while another replica is the leader")
+	flag.BoolVar(&once, "once", false, "List the endpoints and write the nodes file once, then exit, e.g. in an init container")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the node list to stdout whenever it would be written, instead of writing the nodes file")
+	flag.StringVar(&sortBy, "sort-by", "host", "How to order the nodes in the nodes file: host to order them by IP, then by name, or pod to order them by pod name, with StatefulSet ordinals in numeric order (ts-0, ts-1, ... ts-10), where pods are known")
+	flag.IntVar(&maxNodes, "max-nodes", 0, "The most nodes to list. If more are found, -max-nodes-action is taken (no limit if 0)")
+	flag.StringVar(&maxNodesAction, "max-nodes-action", "truncate", "What to do when more than -max-nodes nodes are found: truncate to list the same -max-nodes of them on every replica, going by pod ordinal, or hold to keep the previous nodes file and report not ready")
+	flag.IntVar(&minNodes, "min-nodes", 0, "Keep the previous nodes file if fewer nodes than this are found, so that at least 1 never writes an empty one. With -once, exit with an error instead")
+	flag.DurationVar(&minNodesOverrideAfter, "min-nodes-override-after", 0, "Write the nodes file anyway once fewer than -min-nodes nodes have been found for this long (never if zero)")
+	flag.DurationVar(&startupTimeout, "startup-timeout", 2*time.Minute, "How long to keep retrying while the Kubernetes API can't be reached at startup before giving up (never if zero)")
+	flag.DurationVar(&apiTimeout, "api-timeout", 30*time.Second, "How long to wait for each Kubernetes API request, or for a watch to be established, before giving up on it and retrying later (no limit if zero)")
+	flag.DurationVar(&resyncInterval, "resync-interval", 5*time.Minute, "How often to recompute the node list even if no endpoints have changed")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 10*time.Minute, "How often to list the endpoints from the API, bypassing the watch cache, and repair the nodes file if it differs (disabled if zero)")
+	flag.DurationVar(&debounce, "debounce", 2*time.Second, "How long to wait for endpoint changes to settle before writing the nodes file")
+	flag.DurationVar(&debounceMax, "debounce-max", 10*time.Second, "The longest to delay writing the nodes file while endpoint changes keep arriving")
+	flag.DurationVar(&pollInterval, "poll-interval", 0, "Poll the endpoints this often, a little jittered, instead of watching them, for where RBAC only grants get and list. Endpoints are polled anyway if watching them is forbidden, every 30s unless this is set (disabled if 0)")
+	flag.DurationVar(&minWriteInterval, "min-write-interval", 0, "The least time to leave between writes of the nodes file. A change that comes sooner is held back until then, and the latest node list written. The first write, and writes of a missing nodes file or into or out of bootstrap mode, aren't held back (disabled if 0)")
+	flag.DurationVar(&maxEmptyDuration, "max-empty-duration", 0, "Report not ready once no nodes have been discovered for this long, not counting -extra-nodes or those predicted when bootstrapping (disabled if 0)")
+	flag.DurationVar(&exitOnEmptyAfter, "exit-on-empty-after", 0, "Exit with an error once no nodes have been discovered for this long, so that the container restarts and the crash loop shows up (disabled if 0)")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 5*time.Second, "How long to wait for an in-flight write to finish when shutting down")
+	flag.StringVar(&healthAddr, "health-addr", "", "The address to serve the /livez and /readyz health endpoints and the /status endpoint on, e.g. :9090 (disabled if empty)")
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "The address to serve the Go runtime profiling endpoints on at /debug/pprof/, e.g. localhost:6060, for debugging only (disabled if empty). May be the same as -health-addr or -metrics-addr")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "The address to serve Prometheus metrics on at /metrics, e.g. :9090 (disabled if empty). Also serves /status if -health-addr isn't set")
+	flag.DurationVar(&readyStaleness, "ready-staleness", 0, "Report not ready if the nodes file hasn't been confirmed up to date for this long, which should be longer than -resync-interval (disabled if zero)")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level of log messages to output (debug, info, warn or error)")
+	flag.StringVar(&logFormat, "log-format", "text", "The format to output log messages in (text or json)")
+	flag.BoolVar(&debug, "debug", false, "Shorthand for -log-level=debug")
 	flag.Parse()
 
-	configPath := filepath.Join(homedir.HomeDir(), ".kube", "config")
+	if err := setFlagsFromEnv(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
+
+	if err := loadConfigFile(); err != nil {
+		slog.Error("invalid configuration file", "error", err)
+		os.Exit(2)
+	}
+
+	if err := setupLogging(); err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		os.Exit(2)
+	}
+
+	logConfig()
+
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// setupLogging configures the default logger according to the logging flags. The text format is
+// the standard library's default, matching the output of earlier versions.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", logLevel)
+	}
+
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	switch logFormat {
+	case "text":
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", logFormat)
+	}
+
+	return nil
+}
+
+// run watches the endpoints of the services and keeps the nodes file up to date, until it's told to
+// stop or fails.
+func run() error {
+	if ipFamily != "ipv4" && ipFamily != "ipv6" {
+		return fmt.Errorf("invalid IP family %q, must be ipv4 or ipv6", ipFamily)
+	}
+
+	if discoveryMode != "endpoints" && discoveryMode != "pods" && discoveryMode != "dns" {
+		return fmt.Errorf("invalid discovery mode %q, must be endpoints, pods or dns", discoveryMode)
+	}
+
+	if set := dnsIncompatible(); discoveryMode == "dns" && len(set) > 0 {
+		return fmt.Errorf("-discovery-mode=dns doesn't use the Kubernetes API, so can't be used with %s", strings.Join(set, ", "))
+	}
+
+	if requireContainerReady && typesenseContainer == "" {
+		return errors.New("-require-container-ready needs -typesense-container to name the container to check")
+	}
+
+	if signalProcess != "" && signalPIDFile != "" {
+		return errors.New("only one of -signal-process and -signal-pid-file can be set")
+	}
+
+	if signalProcess != "" || signalPIDFile != "" {
+		var err error
+		if processSignal, err = parseSignal(signalName); err != nil {
+			return err
+		}
+	}
+
+	if addressSource != "internal" && addressSource != "external" {
+		return fmt.Errorf("invalid address source %q, must be internal or external", addressSource)
+	}
+
+	nodeOptions = discovery.Options{
+		PeerPort:               peerPort,
+		APIPort:                apiPort,
+		PeerPortName:           peerPortName,
+		APIPortName:            apiPortName,
+		IPFamily:               ipFamily,
+		IncludeNotReady:        includeNotReady,
+		IncludeNotReadyBelow:   includeNotReadyBelow,
+		UseHostnames:           useHostnames || hostnamesFromPods,
+		PublishedHostnamesOnly: publishedHostnamesOnly,
+		SortByPod:              sortBy == "pod",
+		ClusterDomain:          clusterDomain,
+		TerminatingGrace:       terminatingGrace,
+	}
+
+	if writeAttempts < 1 {
+		return fmt.Errorf("invalid write attempts %d, must be at least 1", writeAttempts)
+	}
+
+	if writeRetryInterval < 0 {
+		return fmt.Errorf("invalid write retry interval %s, must not be negative", writeRetryInterval)
+	}
+
+	if len(nodesFiles) == 0 {
+		nodesFiles = []string{"/usr/share/typesense/nodes"}
+	}
+
+	// Each file is written on its own, so that failing to write one doesn't hold up the others.
+	nodesWriter := nodesfile.Writer{
+		Mode:          nodesFileMode,
+		UID:           nodesFileUID,
+		GID:           nodesFileGID,
+		Attempts:      writeAttempts,
+		RetryInterval: writeRetryInterval,
+		NoSync:        noFsync,
+	}
+
+	for _, path := range nodesFiles {
+		w := nodesWriter
+		w.Path = path
+		nodesTargets = append(nodesTargets, newFileTarget(w, false))
+	}
+
+	if jsonFile != "" {
+		w := nodesWriter
+		w.Path = jsonFile
+		nodesTargets = append(nodesTargets, newFileTarget(w, true))
+	}
+
+	if stateFile != "" {
+		w := nodesWriter
+		w.Path = stateFile
+		stateWriter = &w
+	}
+
+	if formatTemplate != "" || nodesFormat != "typesense" && nodesFormat != "json" {
+		var err error
+		if nodesTemplate, err = discovery.ParseTemplate(nodesFormat, formatTemplate); err != nil {
+			return fmt.Errorf("invalid nodes file format: %w", err)
+		}
+	}
+
+	if bootstrapTimeoutAction != "keep" && bootstrapTimeoutAction != "exit" {
+		return fmt.Errorf("invalid bootstrap timeout action %q, must be keep or exit", bootstrapTimeoutAction)
+	}
+
+	if sortBy != "host" && sortBy != "pod" {
+		return fmt.Errorf("invalid sort order %q, must be host or pod", sortBy)
+	}
+
+	if maxNodesAction != "truncate" && maxNodesAction != "hold" {
+		return fmt.Errorf("invalid max nodes action %q, must be truncate or hold", maxNodesAction)
+	}
+
+	if verifySelfAction != "omit" && verifySelfAction != "report" {
+		return fmt.Errorf("invalid verify self action %q, must be omit or report", verifySelfAction)
+	}
+
+	if webhookURL != "" {
+		if err := validateWebhookURL(); err != nil {
+			return err
+		}
+	}
+
+	if webhookSecretEnv != "" && os.Getenv(webhookSecretEnv) == "" {
+		return fmt.Errorf("-webhook-secret-env names $%s, which isn't set", webhookSecretEnv)
+	}
+
+	if verifyPeerPortAction != "omit" && verifyPeerPortAction != "report" {
+		return fmt.Errorf("invalid verify peer port action %q, must be omit or report", verifyPeerPortAction)
+	}
+
+	resolveOwnPod()
+
+	if bootstrapHandover <= 0 || bootstrapHandover > 1 {
+		return fmt.Errorf("invalid bootstrap handover %v, must be more than 0 and at most 1", bootstrapHandover)
+	}
+
+	namespaces = splitList(namespace)
+	if len(namespaces) == 0 {
+		return errors.New("no namespace given")
+	}
+
+	services = splitList(service)
+	if len(services) == 0 {
+		return errors.New("no service given")
+	}
 
-	var config *rest.Config
 	var err error
+	if staticNodes, err = parseStaticNodes(); err != nil {
+		return err
+	}
+
+	// Seed the last written node list from any existing file, so a restart with unchanged
+	// endpoints doesn't rewrite it.
+	seedLastNodes()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// SIGHUP has tsns reconcile straight away. It's caught from the start, so that it doesn't stop
+	// tsns while it's starting up. Signals that arrive while one is waiting to be handled are
+	// coalesced into it.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if startupTimeout > 0 {
+		startupDeadline = time.Now().Add(startupTimeout)
+	}
+
+	restoreState(ctx)
+
+	// In DNS discovery mode there's no Kubernetes API to connect to, and the local cluster has no
+	// clients.
+	var clients kubernetes.Interface
+	clusters := []cluster{{}}
+	if discoveryMode != "dns" {
+		if clients, clusters, err = connect(); err != nil {
+			return err
+		}
+	}
+
+	checkOwnPod(ctx, clients)
+
+	if verifySelfHealth && podName == "" {
+		return errors.New("-verify-self requires -pod-name to tell which node is this pod's own")
+	}
+
+	if outputConfigMap != "" && clients != nil {
+		nodesTargets = append(nodesTargets, &nodesTarget{sink: &configMapSink{clients: clients}})
+	}
+
+	if webhookURL != "" {
+		nodesTargets = append(nodesTargets, &nodesTarget{sink: newWebhookSink(ctx, !once), background: !once})
+	}
+
+	if selector != "" {
+		if podSelector, err = labels.Parse(selector); err != nil {
+			return fmt.Errorf("invalid selector %q: %w", selector, err)
+		}
+	}
+
+	if nodeSelector != "" {
+		if kubeNodeSelector, err = labels.Parse(nodeSelector); err != nil {
+			return fmt.Errorf("invalid node selector %q: %w", nodeSelector, err)
+		}
+	}
+
+	if !skipPreflight && discoveryMode != "dns" {
+		if err := preflight(ctx, clients); err != nil {
+			return err
+		}
+	}
+
+	if sameZoneOnly {
+		localZone = zoneOverride
+		if localZone == "" {
+			err := retryStartup(ctx, "find own zone", func(ctx context.Context) (err error) {
+				localZone, err = findLocalZone(ctx, clients)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to find own zone: %w", err)
+			}
+		}
+
+		if localZone != "" {
+			slog.Info("only listing nodes in the local zone", "zone", localZone)
+		}
+	}
+
+	if waitQuorum {
+		return waitForQuorum(ctx, clusters)
+	}
+
+	if once {
+		return runOnce(ctx, clusters)
+	}
+
+	if healthAddr != "" {
+		handleHealth(serverMux(healthAddr))
+	}
+	if metricsAddr != "" {
+		serverMux(metricsAddr).Handle("/metrics", promhttp.Handler())
+	}
+	if pprofAddr != "" {
+		slog.Warn("serving profiling endpoints, which expose the internals of tsns and are for debugging only", "addr", pprofAddr, "path", "/debug/pprof/")
+		handlePprof(serverMux(pprofAddr))
+	}
+
+	// The status endpoint is served alongside the health endpoints, or the metrics if there are
+	// none.
+	if addr := cmp.Or(healthAddr, metricsAddr); addr != "" {
+		handleStatus(serverMux(addr))
+	}
+
+	serverErrs := serveHTTP(ctx)
+	startEvents(clients)
 
-	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
-		// No config file found, fall back to in-cluster config.
-		config, err = rest.InClusterConfig()
+	if raftPollInterval > 0 {
+		go pollRaft(ctx)
+	}
+
+	nodesSeen.set(time.Now())
+
+	// Each service in each namespace of each cluster gets its own informer, so that list and watch
+	// requests stay scoped to the endpoints of that service and RBAC can be limited to them by
+	// namespace and name.
+	var factories []informers.SharedInformerFactory
+	var sources []*source
+	var localInformers []cache.SharedIndexInformer
+	for _, c := range clusters {
+		for _, ns := range namespaces {
+			for _, svc := range services {
+				// Getting a service is retried in the local cluster, as at startup it may not be
+				// reachable yet. A remote cluster that can't be reached is skipped.
+				getService := func(get func(ctx context.Context) error) error {
+					if c.name == "" {
+						return retryStartup(ctx, "get service", get)
+					}
+					return get(ctx)
+				}
+
+				// ExternalName services have no endpoints, so their external names are resolved
+				// instead, by a polled source.
+				if discoveryMode != "dns" {
+					var host string
+					err := getService(func(ctx context.Context) (err error) {
+						host, err = externalName(ctx, c.clients, ns, svc)
+						return err
+					})
+					if err != nil {
+						if c.name == "" {
+							return fmt.Errorf("failed to get service %s/%s: %w", ns, svc, err)
+						}
+
+						slog.Warn("failed to get service in remote cluster, skipping it", "cluster", c.name, "namespace", ns, "service", svc, "error", err)
+						continue
+					}
+
+					if host != "" {
+						slog.Info("resolving external name of service", "cluster", c.name, "namespace", ns, "service", svc, "external_name", host, "poll_interval", pollEvery())
+
+						// Failing to resolve the name at startup isn't fatal, as the nodes behind it
+						// are outside the cluster, and it's tried again on every poll. Until then,
+						// the nodes saved for it are used.
+						src := newExternalNameSource(c, ns, svc, host)
+						if src.polled, err = src.list(ctx); err != nil {
+							slog.Warn("failed to resolve external name of service", "cluster", c.name, "namespace", ns, "service", svc, "external_name", host, "error", err)
+							src.polled = savedNodes[sourceKey(c.name, ns, svc)]
+						}
+
+						sources = append(sources, src)
+						continue
+					}
+				}
+
+				// In pods discovery mode, a service's pods are found by its selector, as it was at
+				// startup.
+				var podLabels string
+				if discoveryMode == "pods" {
+					err := getService(func(ctx context.Context) (err error) {
+						podLabels, err = serviceSelector(ctx, c.clients, ns, svc)
+						return err
+					})
+					if err != nil {
+						if c.name == "" {
+							return fmt.Errorf("failed to get service %s/%s: %w", ns, svc, err)
+						}
+
+						slog.Warn("failed to get service in remote cluster, skipping it", "cluster", c.name, "namespace", ns, "service", svc, "error", err)
+						continue
+					}
+				}
+
+				polling := pollInterval > 0 || discoveryMode == "dns"
+				if !polling && watchForbidden(ctx, c.clients, ns, svc, podLabels) {
+					slog.Warn("not allowed to watch endpoints, polling them instead", "cluster", c.name, "namespace", ns, "service", svc, "poll_interval", pollEvery())
+					polling = true
+				}
+
+				factory, src := newSource(c, ns, svc, podLabels, polling)
+				factories = append(factories, factory)
+				sources = append(sources, src)
+
+				// Until it's first listed, a polled source has only what was saved for it to go on.
+				if polling {
+					src.polled = savedNodes[sourceKey(c.name, ns, svc)]
+				}
+
+				// A polled source has no cache to sync, so the local cluster's endpoints are listed
+				// once before going on instead.
+				if polling && c.name == "" {
+					err := retryStartup(ctx, "list endpoints", func(ctx context.Context) (err error) {
+						src.polled, err = src.list(ctx)
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("failed to list endpoints of %s/%s: %w", ns, svc, err)
+					}
+				}
+
+				if !polling && c.name == "" {
+					localInformers = append(localInformers, src.informer)
+				}
+			}
+		}
+	}
+
+	// With a pod selector or pod annotations, the matching pods in each namespace are cached
+	// too, so that checking them doesn't mean a request per endpoint on every reconcile.
+	var podInformers []cache.SharedIndexInformer
+	var lookupPod podLookup
+	if usePods() {
+		lookups := make(map[string]podLookup, len(clusters)*len(namespaces))
+		for _, c := range clusters {
+			for _, ns := range namespaces {
+				factory, informer, lookup := newPodCache(c, ns)
+				factories = append(factories, factory)
+				podInformers = append(podInformers, informer)
+				lookups[c.name+"/"+ns] = lookup
+
+				if c.name == "" {
+					localInformers = append(localInformers, informer)
+				}
+			}
+		}
+
+		lookupPod = func(n discovery.Endpoint) (*corev1.Pod, error) {
+			if lookup, ok := lookups[n.Cluster+"/"+n.Namespace]; ok {
+				return lookup(n)
+			}
+			return nil, nil
+		}
+	}
+
+	// With external addresses, the per-pod Services in each namespace are cached in the same way.
+	var serviceInformers []cache.SharedIndexInformer
+	var lookupService serviceLookup
+	if addressSource == "external" {
+		lookups := make(map[string]serviceLookup, len(clusters)*len(namespaces))
+		for _, c := range clusters {
+			for _, ns := range namespaces {
+				factory, informer, lookup := newExternalCache(c, ns)
+				factories = append(factories, factory)
+				serviceInformers = append(serviceInformers, informer)
+				lookups[c.name+"/"+ns] = lookup
+
+				if c.name == "" {
+					localInformers = append(localInformers, informer)
+				}
+			}
+		}
+
+		lookupService = func(n discovery.Endpoint) (*corev1.Service, error) {
+			if lookup, ok := lookups[n.Cluster+"/"+n.Namespace]; ok {
+				return lookup(n)
+			}
+			return nil, nil
+		}
+	}
+
+	// With -same-zone-only or a node selector, each cluster's Kubernetes nodes are cached too.
+	var kubeNodeInformers []cache.SharedIndexInformer
+	var lookupKubeNode kubeNodeLookup
+	if useKubeNodes() {
+		lookups := make(map[string]func(string) (*corev1.Node, error), len(clusters))
+		for _, c := range clusters {
+			factory, informer, lookup := newKubeNodeCache(c)
+			factories = append(factories, factory)
+			kubeNodeInformers = append(kubeNodeInformers, informer)
+			lookups[c.name] = lookup
+
+			if c.name == "" {
+				localInformers = append(localInformers, informer)
+			}
+		}
+
+		lookupKubeNode = func(n discovery.Endpoint) (*corev1.Node, error) {
+			if lookup, ok := lookups[n.Cluster]; ok {
+				return lookup(n.NodeName)
+			}
+			return nil, nil
+		}
+	}
+
+	// When bootstrapping, the StatefulSet is cached too, so that the predicted nodes follow it if it's
+	// scaled before any endpoints appear.
+	var statefulSetInformers []cache.SharedIndexInformer
+	var getStatefulSet statefulSetGetter
+	if bootstrapFromStatefulSet {
+		var name string
+		err := retryStartup(ctx, "find statefulset", func(ctx context.Context) (err error) {
+			name, err = bootstrapStatefulSetName(ctx, clients)
+			return err
+		})
 		if err != nil {
-			log.Fatalf("failed to build local config: %s\n", err)
+			return fmt.Errorf("failed to find statefulset to bootstrap from: %w", err)
 		}
-	} else {
-		config, err = clientcmd.BuildConfigFromFlags("", configPath)
+
+		factory, informer, get := newStatefulSetCache(clients, name)
+		factories = append(factories, factory)
+		statefulSetInformers = append(statefulSetInformers, informer)
+		localInformers = append(localInformers, informer)
+		getStatefulSet = get
+	}
+
+	// Only the local cluster has to have synced before the node list is written. Remote clusters
+	// may be unreachable, and their nodes are added as their caches sync. A remote cluster that
+	// becomes unreachable later keeps its cache, so its last known nodes stay listed meanwhile.
+	synced := func() bool {
+		for _, informer := range localInformers {
+			if !informer.HasSynced() {
+				return false
+			}
+		}
+		return true
+	}
+
+	events := make(chan string)
+
+	// fatal carries an error that the event loop can't carry on from, such as the bootstrap timing
+	// out, to stop tsns with.
+	fatal := make(chan error, 1)
+
+	r := newReconciler(clients, sources, events, fatal, newHookRunner(ctx))
+	r.lookupPod = lookupPod
+	r.lookupService = lookupService
+	r.lookupKubeNode = lookupKubeNode
+	r.getStatefulSet = getStatefulSet
+	r.synced = synced
+
+	// Pick up from the state recorded on this sidecar's own pod before it restarted, if the nodes
+	// file is unchanged since.
+	r.lastWritten = restorePodState(ctx, clients)
+	if bootstrapping.Load() && bootstrapTimeout > 0 {
+		time.AfterFunc(bootstrapTimeout-time.Since(bootstrapSince), func() {
+			select {
+			case events <- reasonBootstrap:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	reconcile := func(reason string, eventCount int) {
+		r.reconcile(ctx, reason, eventCount)
+	}
+
+	notify := func(reason string) {
+		r.notify(ctx, reason)
+	}
+
+	// A terminating pod is only dropped once the terminating grace period has passed, so reconcile
+	// again then, in case nothing else changes by then.
+	afterTerminatingGrace := func(old, new interface{}) {
+		a, isPod := old.(*corev1.Pod)
+		b, _ := new.(*corev1.Pod)
+		if isPod && terminatingGrace > 0 && a.DeletionTimestamp == nil && b.DeletionTimestamp != nil {
+			time.AfterFunc(terminatingGrace, func() { notify(reasonEndpoints) })
+		}
+	}
+
+	watched := make([]cache.SharedIndexInformer, 0, len(sources)+len(podInformers))
+	for _, src := range sources {
+		if !src.polling {
+			watched = append(watched, src.informer)
+		}
+	}
+	watched = append(watched, podInformers...)
+	watched = append(watched, serviceInformers...)
+	watched = append(watched, statefulSetInformers...)
+	watched = append(watched, kubeNodeInformers...)
+
+	for _, informer := range watched {
+		informer.SetWatchErrorHandler(handleWatchError)
+	}
+
+	for _, src := range sources {
+		if src.polling {
+			continue
+		}
+
+		src.informer.AddEventHandler(sourceEventHandler(notify, afterTerminatingGrace))
+	}
+
+	// Pods only matter as they start or stop matching the selector, start terminating, or their
+	// annotations change, and pod updates are frequent, so other updates are ignored.
+	for _, informer := range podInformers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { notify(reasonEndpoints) },
+			UpdateFunc: func(old, new interface{}) {
+				if podChanged(old.(*corev1.Pod), new.(*corev1.Pod)) {
+					notify(reasonEndpoints)
+				}
+				afterTerminatingGrace(old, new)
+			},
+			DeleteFunc: func(interface{}) { notify(reasonEndpoints) },
+		})
+	}
+
+	// Per-pod Services change as load balancers are provisioned for them.
+	for _, informer := range serviceInformers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { notify(reasonEndpoints) },
+			UpdateFunc: func(old, new interface{}) {
+				if old.(metav1.Object).GetResourceVersion() != new.(metav1.Object).GetResourceVersion() {
+					notify(reasonEndpoints)
+				}
+			},
+			DeleteFunc: func(interface{}) { notify(reasonEndpoints) },
+		})
+	}
+
+	// Kubernetes nodes are updated often, but only changes to their labels matter.
+	for _, informer := range kubeNodeInformers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { notify(reasonEndpoints) },
+			UpdateFunc: func(old, new interface{}) {
+				if kubeNodeChanged(old.(*corev1.Node), new.(*corev1.Node)) {
+					notify(reasonEndpoints)
+				}
+			},
+			DeleteFunc: func(interface{}) { notify(reasonEndpoints) },
+		})
+	}
+
+	// Only changes to the StatefulSet's size or governing service change the predicted nodes.
+	for _, informer := range statefulSetInformers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { notify(reasonEndpoints) },
+			UpdateFunc: func(old, new interface{}) {
+				a, b := old.(*appsv1.StatefulSet), new.(*appsv1.StatefulSet)
+				if predictionKey(a) != predictionKey(b) {
+					notify(reasonEndpoints)
+				}
+			},
+			DeleteFunc: func(interface{}) { notify(reasonEndpoints) },
+		})
+	}
+
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+	}
+
+	if leaderElect {
+		err := runLeaderElection(ctx, clients, func() {
+			select {
+			case events <- reasonLeader:
+			case <-ctx.Done():
+			}
+		})
 		if err != nil {
-			log.Fatalf("failed to build in-cluster config: %s\n", err)
+			return err
 		}
 	}
 
-	clients, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("failed to create kubernetes client: %s\n", err)
+	slog.Info("watching endpoints", "namespaces", namespaces, "services", services, "remote_clusters", len(clusters)-1)
+
+	// The informers retry failed lists and watches themselves, so this only has to give up on them
+	// once the startup deadline passes.
+	syncCtx, cancelSync := withStartupDeadline(ctx)
+	defer cancelSync()
+
+	if !cache.WaitForCacheSync(syncCtx.Done(), synced) {
+		if ctx.Err() != nil {
+			slog.Info("shutting down")
+			return nil
+		}
+		return fmt.Errorf("failed to sync endpoints cache within %s", startupTimeout)
 	}
 
-	watcher, err := clients.CoreV1().Endpoints(namespace).Watch(context.Background(), metav1.ListOptions{})
-	if err != nil {
-		log.Fatalf("failed to create endpoints watcher: %s\n", err)
+	health.setSynced()
+	reconcile(reasonStartup, 0)
+
+	if reconcileInterval > 0 {
+		go tick(ctx, reconcileInterval, events, reasonReconcile)
 	}
 
-	for range watcher.ResultChan() {
-		nodes := getNodes(clients)
-		if len(nodes) > 0 {
-			err := os.WriteFile(nodesFile, []byte(getNodes(clients)), 0666)
-			if err != nil {
-				log.Printf("failed to write nodes file: %s\n", err)
+	for _, src := range sources {
+		if src.polling {
+			go poll(ctx, pollEvery(), events)
+			break
+		}
+	}
+
+	if configFile != "" {
+		go watchConfigFile(ctx, events)
+	}
+
+	if exitOnEmptyAfter > 0 {
+		go exitOnEmpty(ctx, fatal)
+	}
+
+	if watchNodes && !dryRun {
+		err := watchNodesFiles(ctx, nodesFiles, func() {
+			nodesFileChanged.Store(true)
+			select {
+			case events <- reasonNodesFile:
+			case <-ctx.Done():
 			}
+		})
+		if err != nil {
+			slog.Warn("failed to watch nodes file, it will only be repaired by periodic reconciles", "files", nodesFiles, "error", err)
 		}
 	}
+
+	// The informers keep running in the background, notifying us as endpoints change and again
+	// every resync interval, until we're told to stop.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		debounceEvents(ctx, events, hup, reconcile)
+	}()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case err = <-serverErrs:
+		stop()
+	case err = <-fatal:
+		stop()
+	}
+
+	// Give any reconcile that's already underway the chance to finish writing.
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		slog.Warn("timed out waiting for in-flight reconcile to finish")
+	}
+
+	return err
 }
 
-func getNodes(clients *kubernetes.Clientset) string {
-	var nodes []string
+// runOnce lists the endpoints of the services and writes the nodes file a single time, for use in an
+// init container. It fails if fewer than the minimum number of nodes are found.
+func runOnce(ctx context.Context, clusters []cluster) error {
+	local := clusters[0]
 
-	endpoints, err := clients.CoreV1().Endpoints(namespace).List(context.Background(), metav1.ListOptions{})
+	var candidates []discovery.Endpoint
+	err := retryStartup(ctx, "list endpoints", func(ctx context.Context) (err error) {
+		candidates, err = listNodes(ctx, local)
+		return err
+	})
 	if err != nil {
-		log.Printf("failed to list endpoints: %s\n", err)
-		return ""
+		return fmt.Errorf("failed to list endpoints: %w", err)
 	}
 
-	for _, e := range endpoints.Items {
-		if e.Name != service {
+	// An unreachable remote cluster isn't a reason to fail, so remote clusters are only tried once.
+	for _, c := range clusters[1:] {
+		found, err := listNodes(ctx, c)
+		if err != nil {
+			slog.Warn("failed to list endpoints in remote cluster", "cluster", c.name, "error", err)
 			continue
 		}
+		candidates = append(candidates, found...)
+	}
 
-		for _, s := range e.Subsets {
-			for _, a := range s.Addresses {
-				nodes = append(nodes, fmt.Sprintf("%s:%d:%d", a.IP, peerPort, apiPort))
-			}
+	var lookupPod podLookup
+	if usePods() {
+		err = retryStartup(ctx, "list pods", func(ctx context.Context) (err error) {
+			lookupPod, err = listPodLookup(ctx, clusters)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list pods: %w", err)
+		}
+	}
+
+	candidates, dropped, err := selectNodes(nodeOptions.Dedupe(candidates), lookupPod)
+	if err != nil {
+		return fmt.Errorf("failed to look up pods: %w", err)
+	}
+
+	candidates = nodeOptions.LimitNotReady(candidates)
+
+	var lookupKubeNode kubeNodeLookup
+	if useKubeNodes() {
+		err = retryStartup(ctx, "list kubernetes nodes", func(ctx context.Context) (err error) {
+			lookupKubeNode, err = listKubeNodeLookup(ctx, clusters)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list kubernetes nodes: %w", err)
+		}
+	}
+
+	if candidates, err = sameZoneNodes(candidates, lookupKubeNode); err != nil {
+		return fmt.Errorf("failed to look up zones: %w", err)
+	}
+
+	if candidates, dropped.nodeSelector, err = kubeNodeSelected(candidates, lookupKubeNode); err != nil {
+		return fmt.Errorf("failed to look up kubernetes nodes: %w", err)
+	}
+
+	var lookupService serviceLookup
+	if addressSource == "external" {
+		err = retryStartup(ctx, "list per-pod services", func(ctx context.Context) (err error) {
+			lookupService, err = listServiceLookup(ctx, clusters)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list per-pod services: %w", err)
+		}
+	}
+
+	if candidates, err = externalNodes(candidates, lookupService); err != nil {
+		return fmt.Errorf("failed to look up per-pod services: %w", err)
+	}
+
+	var getStatefulSet statefulSetGetter
+	if bootstrapFromStatefulSet {
+		err = retryStartup(ctx, "get statefulset", func(ctx context.Context) error {
+			name, err := bootstrapStatefulSetName(ctx, local.clients)
+			if err != nil {
+				return err
+			}
+
+			getStatefulSet, err = getStatefulSetOnce(ctx, local.clients, name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get statefulset to bootstrap from: %w", err)
+		}
+	}
+
+	if candidates, err = bootstrapNodes(ctx, verifyPeerPorts(ctx, verifyNodes(ctx, verifySelf(ctx, candidates))), getStatefulSet); err != nil {
+		return fmt.Errorf("failed to get statefulset to bootstrap from: %w", err)
+	}
+
+	candidates = withStaticNodes(candidates)
+
+	if maxNodesAction == "truncate" {
+		var truncated int
+		if candidates, truncated = capNodes(candidates); truncated > 0 {
+			slog.Warn("too many nodes found, leaving some out", "node_count", len(candidates)+truncated, "max_nodes", maxNodes, "truncated", truncated)
+		}
+	}
+
+	reportSharedEntries(candidates)
+	nodes := nodeOptions.Format(candidates)
+
+	count := len(candidates)
+	if count < minNodes {
+		return fmt.Errorf("found %d nodes, fewer than the minimum of %d", count, minNodes)
+	}
+	if maxNodes > 0 && count > maxNodes {
+		return fmt.Errorf("found %d nodes, more than the maximum of %d", count, maxNodes)
+	}
+
+	previous := lastNodes
+	written, err := writeNodes(ctx, candidates, nodes, reasonOnce)
+	if err != nil {
+		return fmt.Errorf("failed to write nodes file: %w", err)
+	}
+
+	if written {
+		runHooks(ctx, nodes, reasonOnce)
+		recordPodState(ctx, local.clients, nodes)
+		saveState(ctx, candidates)
+	}
+
+	added, removed, unchanged := discovery.Diff(previous, nodes)
+	slog.Info("listed endpoints", "namespaces", namespaces, "services", services, "node_count", count, "added", added, "removed", removed, "unchanged", unchanged, "service_nodes", serviceCounts(candidates), "excluded_pods", dropped.excluded, "terminating_pods", dropped.terminating, "not_ready_pods", dropped.notReady, "node_selector_excluded", dropped.nodeSelector, "unreachable_peers", unreachablePeers, "files", nodesFiles, "written", written)
+	return nil
+}
+
+// listNodes builds the node list from the endpoints of the services in the given cluster, as listed
+// from its API server, without going through an informer.
+func listNodes(ctx context.Context, c cluster) ([]discovery.Endpoint, error) {
+	var nodes []discovery.Endpoint
+	for _, ns := range namespaces {
+		for _, svc := range services {
+			var found []discovery.Endpoint
+			var ok bool
+			var err error
+			if discoveryMode != "dns" {
+				found, ok, err = listExternalNameNodes(ctx, c.clients, ns, svc)
+			}
+			if !ok && err == nil {
+				found, err = listServiceNodes(ctx, c.clients, ns, svc)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("service %s/%s: %w", ns, svc, err)
+			}
+
+			slog.Debug("found nodes", "cluster", c.name, "namespace", ns, "service", svc, "node_count", len(found))
+			nodes = append(nodes, inCluster(c.name, found)...)
+		}
+	}
+
+	return nodes, nil
+}
+
+// listServiceNodes builds the node list from the endpoints of the given service in the given
+// namespace, or in pods discovery mode from its pods, as listed from the API server.
+func listServiceNodes(ctx context.Context, clients kubernetes.Interface, ns, svc string) ([]discovery.Endpoint, error) {
+	if discoveryMode == "dns" {
+		return resolveServiceNodes(ctx, ns, svc)
+	}
+
+	options := metav1.ListOptions{}
+
+	if discoveryMode == "pods" {
+		podLabels, err := serviceSelector(ctx, clients, ns, svc)
+		if err != nil {
+			return nil, err
+		}
+
+		selectEndpoints(svc, podLabels)(&options)
+		list, err := clients.CoreV1().Pods(ns).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		items := make([]*corev1.Pod, 0, len(list.Items))
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+
+		return nodeOptions.FromPods(svc, items, typesenseContainer), nil
+	}
+
+	return newDiscoverer(clients, ns, svc).Endpoints(ctx)
+}
+
+// newDiscoverer returns a discoverer for the endpoints of the given service in the given namespace.
+func newDiscoverer(clients kubernetes.Interface, ns, svc string) *discovery.Discoverer {
+	return &discovery.Discoverer{
+		Client:            clients,
+		Namespace:         ns,
+		Service:           svc,
+		Options:           nodeOptions,
+		UseEndpointSlices: useEndpointSlices,
+		Resync:            resyncInterval,
+	}
+}
+
+// connect returns the clients for the local cluster, and the local cluster along with any remote
+// clusters to discover nodes in.
+func connect() (kubernetes.Interface, []cluster, error) {
+	config, configSource, contextName, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slog.Info("loaded kubernetes config", "source", configSource, "context", contextName, "host", config.Host)
+
+	clients, err := newClients(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+
+	remotes, err := remoteClusters()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clients, append([]cluster{{clients: clients}}, remotes...), nil
+}
+
+// loadConfig returns the config to connect to Kubernetes with, along with a description of where it
+// was loaded from and the name of the kubeconfig context used, if any. The -kubeconfig flag takes
+// precedence, then the KUBECONFIG environment variable, then the default kubeconfig in the home
+// directory, and finally the in-cluster config. Exec credential plugins configured in the
+// kubeconfig are run as needed, but never interactively.
+func loadConfig() (*rest.Config, string, string, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	var source string
+
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+		source = kubeconfig
+	} else if env := os.Getenv("KUBECONFIG"); env != "" {
+		rules.Precedence = filepath.SplitList(env)
+		source = "KUBECONFIG=" + env
+	} else {
+		path := filepath.Join(homedir.HomeDir(), ".kube", "config")
+
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			if kubeContext != "" {
+				return nil, "", "", fmt.Errorf("-kube-context is set to %q but no kubeconfig was found", kubeContext)
+			}
+
+			config, err := rest.InClusterConfig()
+			if err != nil {
+				return nil, "", "", fmt.Errorf("failed to build in-cluster config: %w", err)
+			}
+			return config, "in-cluster", "", nil
+		}
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to check for kubeconfig: %w", err)
+		}
+
+		rules.ExplicitPath = path
+		source = path
+	}
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{
+		CurrentContext: kubeContext,
+	})
+
+	raw, err := clientConfig.RawConfig()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to load kubeconfig from %s: %w", source, err)
+	}
+
+	contextName := raw.CurrentContext
+	if kubeContext != "" {
+		contextName = kubeContext
+	}
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to build config from %s: %w", source, err)
+	}
+
+	return config, source, contextName, nil
+}
+
+// newClients returns the Kubernetes clients for the given config, asking for protobuf with
+// -kube-protobuf. Every API tsns uses is a built-in one that can be served as protobuf, and JSON is
+// still accepted for any response that isn't. Every request is given up on after -api-timeout.
+func newClients(config *rest.Config) (kubernetes.Interface, error) {
+	config = rest.CopyConfig(config)
+	config.Wrap(wrapAPITimeout)
+
+	if kubeProtobuf {
+		config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+		config.ContentType = "application/vnd.kubernetes.protobuf"
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// listsAll reports whether a reconcile for the given reason lists every source from the API server,
+// rather than trusting the caches.
+func listsAll(reason string) bool {
+	return reason == reasonReconcile || reason == reasonRecovered || reason == reasonOperator
+}
+
+// debounceEvents calls reconcile once for each burst of events. A burst ends when no further event
+// has arrived for the debounce period, or when it has lasted for the maximum debounce period. A
+// signal on hup, as from an operator sending SIGHUP, skips the debounce, reconciling straight away
+// with everything listed again, taking any burst so far with it. It returns once ctx is done, dropping
+// any burst that hasn't been reconciled yet.
+func debounceEvents(ctx context.Context, events <-chan string, hup <-chan os.Signal, reconcile func(reason string, events int)) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		health.beat()
+
+		var reason string
+
+		select {
+		case reason = <-events:
+		case <-hup:
+			slog.Info("reconcile triggered by operator", "signal", "SIGHUP")
+			reconcile(reasonOperator, 0)
+			continue
+		case <-heartbeat.C:
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		count := 1
+
+		quiet := time.NewTimer(debounce)
+		deadline := time.NewTimer(debounceMax)
+
+	burst:
+		for {
+			select {
+			case r := <-events:
+				// A burst containing any real change is reported as one, rather than as a resync, unless
+				// it also contains a reconcile that lists everything, which picks up every change anyway.
+				if listsAll(r) || r == reasonEndpoints && !listsAll(reason) {
+					reason = r
+				}
+
+				count++
+				quiet.Stop()
+				quiet = time.NewTimer(debounce)
+			case <-hup:
+				slog.Info("reconcile triggered by operator", "signal", "SIGHUP")
+				reason = reasonOperator
+				break burst
+			case <-quiet.C:
+				break burst
+			case <-deadline.C:
+				break burst
+			case <-ctx.Done():
+				quiet.Stop()
+				deadline.Stop()
+				return
+			}
+		}
+
+		quiet.Stop()
+		deadline.Stop()
+
+		reconcile(reason, count)
+	}
+}
+
+// nodesTarget is a sink the node list is written to, such as one of the nodes files, along with what
+// was last written to it.
+type nodesTarget struct {
+	sink sink.Sink
+
+	// file is the sink if it's one of the nodes files, or the -json-file, which can be read back, or
+	// nil otherwise.
+	file *sink.File
+
+	// json is whether the file is the one given by -json-file, which is always written in the JSON
+	// format.
+	json bool
+
+	// background is whether the sink writes in the background, so that a successful Write only
+	// means the node list was queued, and the sink records how each write went itself.
+	background bool
+
+	// lastNodes holds the canonical form of the node list most recently written to the sink, and
+	// known is whether the sink is known to hold it, so that an empty node list isn't mistaken for
+	// one that's already written when nothing has been.
+	lastNodes string
+	known     bool
+}
+
+// newFileTarget returns a nodesTarget for the file written by w, in the output format, or the JSON
+// format if json is set.
+func newFileTarget(w nodesfile.Writer, json bool) *nodesTarget {
+	t := &nodesTarget{json: json}
+	t.file = &sink.File{Writer: w, Render: t.render}
+	t.sink = t.file
+	return t
+}
+
+// render returns the contents of the file for the given node list, in the file's output format.
+func (t *nodesTarget) render(nodes sink.NodeList) (string, error) {
+	switch {
+	case t.json:
+		return renderJSON(t.file.Name(), nodes.Endpoints)
+	case nodesTemplate != nil:
+		return nodeOptions.Render(nodesTemplate, nodes.Endpoints)
+	case nodesFormat == "json":
+		return renderJSON(t.file.Name(), nodes.Endpoints)
+	}
+
+	return nodes.Nodes, nil
+}
+
+// seed sets the file's last written node list to its contents, or to nothing if it can't be read,
+// so that the file is written again unless it's already up to date. It returns the new last written
+// node list. A file in a custom output format can't be read back, so it's only known to be up to
+// date if it holds exactly what was last written. Other sinks can't be read back at all, so theirs
+// is left as it is.
+func (t *nodesTarget) seed() string {
+	if t.file == nil {
+		return t.lastNodes
+	}
+
+	plain := !t.json && nodesTemplate == nil && nodesFormat != "json"
+
+	b, err := os.ReadFile(t.file.Name())
+	switch {
+	case err != nil || len(b) == 0:
+		t.lastNodes, t.known = "", err == nil && plain
+	case plain:
+		t.lastNodes, t.known = discovery.Canonical(string(b)), true
+	case string(b) != t.file.Last():
+		t.lastNodes, t.known = "", false
+	}
+
+	return t.lastNodes
+}
+
+// sourceEventHandler returns the handler for events from a source's informer, which notifies of
+// each of them, and calls afterUpdate with the objects of each update.
+func sourceEventHandler(notify func(reason string), afterUpdate func(old, new interface{})) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { notify(reasonEndpoints) },
+		UpdateFunc: func(old, new interface{}) {
+			// Resyncs are delivered as updates where nothing has changed.
+			if old.(metav1.Object).GetResourceVersion() == new.(metav1.Object).GetResourceVersion() {
+				notify(reasonResync)
+			} else {
+				notify(reasonEndpoints)
+			}
+			afterUpdate(old, new)
+		},
+		DeleteFunc: func(interface{}) { notify(reasonEndpoints) },
+	}
+}
+
+// writeNodes writes the given node list, for the nodes at the given addresses, to each of the sinks,
+// the nodes files in the output format and any others, if it differs from the node list that was
+// last written to that sink. An empty node list is written like any other, as the reconciler only
+// lets one through when -min-nodes allows it. Each sink is written on its own, so that one failing
+// doesn't hold up the others. It returns true if any nodes file was written, and an error naming
+// each nodes file that couldn't be. Other sinks that fail are only logged, and reported in their
+// own status, so that they never get in the way of the nodes files, and are written again on the
+// next reconcile. Failed writes of the nodes files are tried again, with a growing, jittered delay,
+// up to the number of write attempts. In dry-run mode the file's contents are printed to stdout,
+// along with the reason it would have been written, instead.
+func writeNodes(ctx context.Context, addresses []discovery.Endpoint, nodes, reason string) (bool, error) {
+	canonical := discovery.Canonical(nodes)
+
+	var stale []*nodesTarget
+	for _, t := range nodesTargets {
+		if !t.known || t.lastNodes != canonical {
+			stale = append(stale, t)
+		}
+	}
+
+	if len(stale) == 0 {
+		slog.Debug("node list unchanged, skipping write", "files", nodesFiles, "nodes", nodes)
+		health.recordWrite(nodes)
+		return false, nil
+	}
+
+	if canonical == "" {
+		slog.Warn("no nodes found, writing an empty node list", "files", nodesFiles, "reason", reason)
+	}
+
+	list := sink.NodeList{Nodes: nodes, Endpoints: addresses}
+
+	if dryRun {
+		// The first nodes file is shown if no other file is due to be written.
+		shown := nodesTargets[0]
+		for _, t := range stale {
+			if t.file != nil {
+				shown = t
+				break
+			}
+		}
+
+		contents, err := shown.render(list)
+		if err != nil {
+			err = fmt.Errorf("failed to render nodes file: %w", err)
+			health.recordError(err)
+			writeFailuresTotal.Inc()
+			return false, err
+		}
+
+		fmt.Printf("%s: %s\n", reason, contents)
+		for _, t := range nodesTargets {
+			t.lastNodes, t.known = canonical, true
+		}
+		lastNodes = canonical
+		health.recordWrite(nodes)
+		return true, nil
+	}
+
+	var written, fileWritten bool
+	var errs []error
+
+	for _, t := range stale {
+		name := t.sink.Name()
+
+		if err := t.sink.Write(ctx, list); err != nil {
+			health.recordSinkError(name, err)
+			if t.file == nil {
+				slog.Warn("failed to write node list to sink", "sink", name, "error", err)
+				continue
+			}
+
+			slog.Warn("failed to write nodes file", "file", name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		t.lastNodes, t.known = canonical, true
+		if !t.background {
+			health.recordSinkWrite(name)
+		}
+
+		if t.file != nil {
+			fileWritten = true
+			written = written || !t.json
+		}
+	}
+
+	if fileWritten {
+		lastNodes = canonical
+		writesTotal.Inc()
+		lastWrite.set(time.Now())
+		nodesGauge.Set(float64(discovery.Count(nodes)))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		health.recordError(err)
+		writeFailuresTotal.Inc()
+		return written, err
+	}
+
+	health.recordWrite(nodes)
+	return written, nil
+}
+
+// seedLastNodes seeds the last written node list of each of the nodes files from its contents, and
+// the last written node list overall from the first of them that has one.
+func seedLastNodes() {
+	lastNodes = ""
+	for _, t := range nodesTargets {
+		if n := t.seed(); lastNodes == "" {
+			lastNodes = n
+		}
+	}
+}
+
+// checkNodesFiles seeds the last written node list of each of the nodes files from its contents,
+// as seedLastNodes does, warning about any that no longer hold what was last written to them, so
+// that they're repaired by the next write.
+func checkNodesFiles() {
+	for _, t := range nodesTargets {
+		if written := t.lastNodes; t.seed() != written {
+			slog.Warn("nodes file differs from the node list last written, repairing it", "file", t.file.Name(), "found", cmp.Or(t.lastNodes, "nothing"), "expected", written)
+		}
+	}
+}
+
+// exitOnEmpty sends an error to fatal once no nodes have been discovered for -exit-on-empty-after,
+// unless ctx is done first.
+func exitOnEmpty(ctx context.Context, fatal chan<- error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if since := nodesSeen.since(); since > exitOnEmptyAfter {
+			select {
+			case fatal <- fmt.Errorf("no nodes discovered for %s, exiting", since.Round(time.Second)):
+			default:
+			}
+			return
+		}
+	}
+}
+
+// tick sends the given reason to events every interval, until ctx is done.
+func tick(ctx context.Context, interval time.Duration, events chan<- string, reason string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case events <- reason:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// source is the informer watching the endpoints of a single service, along with functions listing
+// the nodes in its cache and, bypassing the cache, from the API server. A polled source has no
+// informer, and its nodes are those it last listed, in polled.
+type source struct {
+	cluster   string
+	namespace string
+	service   string
+	clients   kubernetes.Interface
+	informer  cache.SharedIndexInformer
+	nodes     func() ([]discovery.Endpoint, error)
+	list      func(ctx context.Context) ([]discovery.Endpoint, error)
+
+	polling bool
+	polled  []discovery.Endpoint
+}
+
+// newSource returns a source for the endpoints of the given service in the given namespace of the
+// given cluster, and the informer factory that must be started for it to run. In pods discovery
+// mode, the source is for the pods matching the given label selector instead. If polling, the
+// source is polled rather than watched. Endpoints and EndpointSlices are watched through a
+// discovery.Discoverer's cache, as other programs using the package watch them.
+func newSource(c cluster, ns, svc, podLabels string, polling bool) (informers.SharedInformerFactory, *source) {
+	src := &source{cluster: c.name, namespace: ns, service: svc, clients: c.clients, polling: polling}
+	src.list = func(ctx context.Context) ([]discovery.Endpoint, error) {
+		nodes, err := listServiceNodes(ctx, c.clients, ns, svc)
+		return inCluster(c.name, nodes), err
+	}
+
+	if !polling && discoveryMode != "pods" {
+		endpoints := newDiscoverer(c.clients, ns, svc).NewCache()
+		src.informer = endpoints.Informer
+		src.nodes = func() ([]discovery.Endpoint, error) {
+			nodes, err := endpoints.Endpoints()
+			return inCluster(c.name, nodes), err
+		}
+
+		return endpoints.Factory, src
+	}
+
+	// A polled source's factory is never used, but is started along with the others all the same.
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clients, resyncInterval,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(selectEndpoints(svc, podLabels)),
+	)
+
+	if polling {
+		src.nodes = func() ([]discovery.Endpoint, error) { return src.polled, nil }
+	} else {
+		pods := factory.Core().V1().Pods()
+		src.informer = pods.Informer()
+		src.nodes = func() ([]discovery.Endpoint, error) {
+			items, err := pods.Lister().Pods(ns).List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			return inCluster(c.name, nodeOptions.FromPods(svc, items, typesenseContainer)), nil
+		}
+	}
+
+	return factory, src
+}
+
+// handleWatchError logs the error an informer's watch ended with, before it lists and watches again.
+// The informer resumes from the last resource version it saw, and opts into bookmarks to keep that
+// fresh, so only an expired resource version makes it list everything again.
+func handleWatchError(r *cache.Reflector, err error) {
+	watchReconnectsTotal.Inc()
+
+	switch {
+	case errors.Is(err, io.EOF):
+		// The watch timed out and was closed normally.
+	case apierrors.IsResourceExpired(err) || apierrors.IsGone(err):
+		slog.Debug("watch resource version expired, relisting", "resource_version", r.LastSyncResourceVersion(), "error", err)
+	default:
+		slog.Warn("watch failed, retrying", "reason", apierrors.ReasonForError(err), "resource_version", r.LastSyncResourceVersion(), "error", err)
+	}
+}
+
+// selectEndpoints returns a function restricting list and watch requests to the endpoints of the
+// given service, or in pods discovery mode to the pods matching the given label selector.
+func selectEndpoints(svc, podLabels string) func(options *metav1.ListOptions) {
+	if discoveryMode != "pods" {
+		return newDiscoverer(nil, "", svc).TweakListOptions
+	}
+
+	return func(options *metav1.ListOptions) {
+		options.LabelSelector = podLabels
+	}
+}
+
+// serviceSelector returns the label selector of the given service, which picks out its pods.
+func serviceSelector(ctx context.Context, clients kubernetes.Interface, ns, svc string) (string, error) {
+	s, err := clients.CoreV1().Services(ns).Get(ctx, svc, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if len(s.Spec.Selector) == 0 {
+		return "", fmt.Errorf("service %s/%s has no selector to find its pods by", ns, svc)
+	}
+
+	return labels.SelectorFromSet(s.Spec.Selector).String(), nil
+}
+
+// withStaticNodes returns the given nodes followed by the static nodes, leaving out any static node
+// on the same host as one of the given nodes. Static nodes are never filtered or health checked.
+func withStaticNodes(nodes []discovery.Endpoint) []discovery.Endpoint {
+	if len(staticNodes) == 0 {
+		return nodes
+	}
+
+	return nodeOptions.Dedupe(append(nodes, staticNodes...))
+}
+
+// reportSharedEntries logs an error for each nodes file entry that nodes for more than one pod have,
+// as hostNetwork pods on the same Kubernetes node do if they use the same ports. Only one of them can
+// be listed, so the others are left out of the cluster. Their ports can be set apart per pod with
+// -peer-port-annotation and -api-port-annotation, or by giving their containers different ports.
+func reportSharedEntries(nodes []discovery.Endpoint) {
+	var entries []string
+	pods := make(map[string][]string)
+
+	for _, n := range nodes {
+		if n.Pod == "" {
+			continue
+		}
+
+		entry := discovery.FormatNode(nodeOptions.Host(n), n.PeerPort, n.APIPort)
+		pod := path.Join(n.Cluster, n.Namespace, n.Pod)
+
+		if _, ok := pods[entry]; !ok {
+			entries = append(entries, entry)
+		}
+		if !slices.Contains(pods[entry], pod) {
+			pods[entry] = append(pods[entry], pod)
+		}
+	}
+
+	for _, entry := range entries {
+		if len(pods[entry]) > 1 {
+			slog.Error("pods share a host and ports, so only one of them can be listed", "entry", entry, "pods", pods[entry])
+		}
+	}
+}
+
+// capNodes returns at most -max-nodes of the given nodes, along with how many were left out. Every
+// replica picks the same ones: nodes are taken in order of their pods' names, with the ordinals of
+// StatefulSet pods compared as numbers, then nodes without pods, including static nodes, by host.
+func capNodes(nodes []discovery.Endpoint) ([]discovery.Endpoint, int) {
+	if maxNodes <= 0 || len(nodes) <= maxNodes {
+		return nodes, 0
+	}
+
+	sorted := slices.Clone(nodes)
+	slices.SortStableFunc(sorted, func(a, b discovery.Endpoint) int {
+		return cmp.Or(discovery.ComparePods(a, b), cmp.Compare(nodeOptions.Host(a), nodeOptions.Host(b)))
+	})
+
+	return sorted[:maxNodes], len(nodes) - maxNodes
+}
+
+// serviceCounts returns the number of the given nodes that belong to each service, keyed by the
+// service's namespace and name.
+func serviceCounts(nodes []discovery.Endpoint) map[string]int {
+	counts := make(map[string]int, len(namespaces)*len(services))
+	for _, n := range nodes {
+		if n.Static {
+			counts["static"]++
+		} else {
+			counts[path.Join(n.Cluster, n.Namespace, n.Service)]++
+		}
+	}
+
+	return counts
+}
+
+// extraNodesValue returns the value of the -extra-nodes flag, or if it isn't set, that of the
+// environment variable named by -extra-nodes-env.
+func extraNodesValue() string {
+	if extraNodes != "" || extraNodesEnv == "" {
+		return extraNodes
+	}
+
+	return os.Getenv(extraNodesEnv)
+}
+
+// parseStaticNodes returns the nodes given by the -extra-nodes flag, reading them from the file it
+// names if it's given as file:/path/to/list.
+func parseStaticNodes() ([]discovery.Endpoint, error) {
+	list := extraNodesValue()
+	if path, ok := strings.CutPrefix(list, "file:"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extra nodes: %w", err)
+		}
+		list = strings.ReplaceAll(strings.TrimSpace(string(b)), "\n", ",")
+	}
+
+	var nodes []discovery.Endpoint
+	for _, entry := range splitList(list) {
+		n, err := discovery.ParseNode(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra node: %w", err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+// reloadStaticNodes reads the -extra-nodes file again, if the nodes are given by one, so that an
+// operator can correct it and send SIGHUP without restarting the pod. Invalid nodes are logged, and
+// the current ones kept.
+func reloadStaticNodes() {
+	path, ok := strings.CutPrefix(extraNodesValue(), "file:")
+	if !ok {
+		return
+	}
+
+	nodes, err := parseStaticNodes()
+	if err != nil {
+		slog.Error("invalid extra nodes file, keeping the current extra nodes", "file", path, "error", err)
+		return
+	}
+
+	slog.Info("read extra nodes file again", "file", path, "node_count", len(nodes))
+
+	// The status endpoint reads the static nodes under the health lock.
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	staticNodes = nodes
+}
+
+// splitList returns the non-empty, trimmed elements of a comma-separated list.
+func splitList(list string) []string {
+	var elems []string
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elems = append(elems, e)
 		}
 	}
 
-	return strings.Join(nodes, ",")
+	return elems
 }
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSourceWatchesOnlyItsService(t *testing.T) {
+	path := setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	other := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "other"},
+		Subsets:    []corev1.EndpointSubset{{Addresses: []corev1.EndpointAddress{{IP: "10.0.1.1"}}}},
+	}
+
+	clients := fake.NewSimpleClientset(tsEndpoints("10.0.0.1"), other)
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+
+	// Both the list and the watch are restricted to the service's Endpoints by name.
+	var restricted int
+	for _, action := range clients.Actions() {
+		var fields string
+		switch a := action.(type) {
+		case k8stesting.ListAction:
+			fields = a.GetListRestrictions().Fields.String()
+		case k8stesting.WatchAction:
+			fields = a.GetWatchRestrictions().Fields.String()
+		default:
+			continue
+		}
+		if fields != "metadata.name=ts" {
+			t.Errorf("%s %s field selector = %q, want metadata.name=ts", action.GetVerb(), action.GetResource().Resource, fields)
+		}
+		restricted++
+	}
+	if restricted < 2 {
+		t.Errorf("saw %d list and watch requests, want at least 2", restricted)
+	}
+
+	r.reconcile(ctx, reasonStartup, 0)
+	written, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake clientset doesn't apply field selectors, so the other service's Endpoints reach the
+	// cache anyway. They still don't get into the node list, or cause the nodes file to be rewritten.
+	other.Subsets[0].Addresses = append(other.Subsets[0].Addresses, corev1.EndpointAddress{IP: "10.0.1.2"})
+	if _, err := clients.CoreV1().Endpoints("typesense").Update(ctx, other, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the update", func() bool {
+		e, ok, err := src.informer.GetStore().GetByKey("typesense/other")
+		return err == nil && ok && len(e.(*corev1.Endpoints).Subsets[0].Addresses) == 2
+	})
+
+	r.reconcile(ctx, reasonEndpoints, 1)
+
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108"; got != want {
+		t.Errorf("nodes file = %q, want %q", got, want)
+	}
+
+	rewritten, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(written, rewritten) {
+		t.Error("nodes file rewritten for an event for another service")
+	}
+}
+
+func TestHandleWatchError(t *testing.T) {
+	r := cache.NewReflector(&cache.ListWatch{}, &corev1.Endpoints{}, cache.NewStore(cache.MetaNamespaceKeyFunc), 0)
+	resource := schema.GroupResource{Resource: "endpoints"}
+
+	for _, err := range []error{
+		io.EOF,
+		apierrors.NewResourceExpired("too old resource version"),
+		apierrors.NewGone("gone"),
+		apierrors.NewForbidden(resource, "ts", errors.New("no")),
+		fmt.Errorf("connection reset: %w", io.ErrUnexpectedEOF),
+	} {
+		before := testutil.ToFloat64(watchReconnectsTotal)
+		handleWatchError(r, err)
+		if got := testutil.ToFloat64(watchReconnectsTotal) - before; got != 1 {
+			t.Errorf("handleWatchError(%v) counted %v reconnects, want 1", err, got)
+		}
+	}
+}
+
+func TestSourceWatchEvents(t *testing.T) {
+	setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := fake.NewSimpleClientset(tsEndpoints("10.0.0.1"))
+
+	// Each watch gets a fake watcher to feed events through, and the resource version it resumes
+	// from is recorded. While failing, watches are refused instead.
+	var mu sync.Mutex
+	var versions []string
+	var failing atomic.Bool
+	watchers := make(chan *watch.FakeWatcher, 10)
+	clients.PrependWatchReactor("endpoints", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if failing.Load() {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "endpoints"}, "ts", errors.New("no"))
+		}
+
+		mu.Lock()
+		versions = append(versions, action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion)
+		mu.Unlock()
+
+		w := watch.NewFakeWithChanSize(10, false)
+		watchers <- w
+		return true, w, nil
+	})
+
+	lists := func() int {
+		var n int
+		for _, action := range clients.Actions() {
+			if action.GetVerb() == "list" {
+				n++
+			}
+		}
+		return n
+	}
+	nextWatcher := func() *watch.FakeWatcher {
+		select {
+		case w := <-watchers:
+			return w
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		t.Fatal("timed out waiting for a watch")
+		return nil
+	}
+
+	factory, src := newSource(cluster{clients: clients}, "typesense", "ts", "", false)
+	src.informer.SetWatchErrorHandler(handleWatchError)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), src.informer.HasSynced) {
+		t.Fatal("source cache didn't sync")
+	}
+
+	w := nextWatcher()
+
+	// A modification and then a bookmark. The watch then ends normally, and is resumed from the
+	// bookmark without listing again.
+	updated := tsEndpoints("10.0.0.1", "10.0.0.2")
+	updated.ResourceVersion = "8"
+	w.Modify(updated)
+	w.Action(watch.Bookmark, &corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "9"}})
+	waitFor(t, "the modification", func() bool { return sourceNodes(t, src) == 2 })
+	w.Stop()
+
+	w = nextWatcher()
+	mu.Lock()
+	resumed := versions[len(versions)-1]
+	mu.Unlock()
+	if resumed != "9" {
+		t.Errorf("watch resumed from resource version %q, want the bookmark's, 9", resumed)
+	}
+	if got := lists(); got != 1 {
+		t.Errorf("listed %d times before the resource version expired, want 1", got)
+	}
+
+	// An expired resource version ends the watch with an error event, and everything is listed
+	// again. A watch that can't be established goes to the error handler.
+	failing.Store(true)
+	reconnects := testutil.ToFloat64(watchReconnectsTotal)
+	w.Error(&metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonExpired})
+
+	waitFor(t, "a relist", func() bool { return lists() > 1 })
+	waitFor(t, "the watch error", func() bool { return testutil.ToFloat64(watchReconnectsTotal) > reconnects })
+
+	failing.Store(false)
+	nextWatcher()
+}
+
+// protobufType is the media type of protobuf-encoded Kubernetes objects.
+const protobufType = "application/vnd.kubernetes.protobuf"
+
+// serveEndpoints returns an API server serving the given Endpoints at a get, list and watch,
+// encoded as protobuf if the client accepts it, or JSON otherwise or if protobuf isn't supported. It
+// records the media types it responded with.
+func serveEndpoints(t *testing.T, e *corev1.Endpoints, protobuf bool, served *[]string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType := "application/json"
+		if protobuf && strings.HasPrefix(r.Header.Get("Accept"), protobufType) {
+			mediaType = protobufType
+		}
+
+		mu.Lock()
+		*served = append(*served, mediaType)
+		mu.Unlock()
+
+		info, _ := runtime.SerializerInfoForMediaType(scheme.Codecs.SupportedMediaTypes(), mediaType)
+		encoder := scheme.Codecs.EncoderForVersion(info.Serializer, corev1.SchemeGroupVersion)
+		w.Header().Set("Content-Type", mediaType)
+
+		var err error
+		switch {
+		case r.URL.Path == "/api/v1/namespaces/typesense/endpoints" && r.URL.Query().Get("watch") == "true":
+			var raw []byte
+			if raw, err = runtime.Encode(encoder, e); err != nil {
+				break
+			}
+
+			stream := streaming.NewEncoder(info.StreamSerializer.Framer.NewFrameWriter(w), info.StreamSerializer.Serializer)
+			err = stream.Encode(&metav1.WatchEvent{Type: string(watch.Added), Object: runtime.RawExtension{Raw: raw}})
+		case r.URL.Path == "/api/v1/namespaces/typesense/endpoints":
+			err = encoder.Encode(&corev1.EndpointsList{Items: []corev1.Endpoints{*e}}, w)
+		case r.URL.Path == "/api/v1/namespaces/typesense/endpoints/ts":
+			err = encoder.Encode(e, w)
+		default:
+			http.NotFound(w, r)
+		}
+		if err != nil {
+			t.Errorf("encoding %s response: %v", mediaType, err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestNewClientsContentTypes(t *testing.T) {
+	tests := []struct {
+		name             string
+		kubeProtobuf     bool
+		servesProtobuf   bool
+		wantResponseType string
+	}{
+		{name: "protobuf", kubeProtobuf: true, servesProtobuf: true, wantResponseType: protobufType},
+		{name: "protobuf unsupported", kubeProtobuf: true, servesProtobuf: false, wantResponseType: "application/json"},
+		{name: "JSON", kubeProtobuf: false, servesProtobuf: true, wantResponseType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set(t, &kubeProtobuf, tt.kubeProtobuf)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var served []string
+			e := tsEndpoints("10.0.0.1", "10.0.0.2")
+			srv := serveEndpoints(t, e, tt.servesProtobuf, &served)
+
+			clients, err := newClients(&rest.Config{Host: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoints := clients.CoreV1().Endpoints("typesense")
+
+			got, err := endpoints.Get(ctx, "ts", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if !reflect.DeepEqual(got.Subsets, e.Subsets) {
+				t.Errorf("get = %v, want %v", got.Subsets, e.Subsets)
+			}
+
+			list, err := endpoints.List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(list.Items) != 1 || !reflect.DeepEqual(list.Items[0].Subsets, e.Subsets) {
+				t.Errorf("list = %v, want the one Endpoints", list.Items)
+			}
+
+			w, err := endpoints.Watch(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("watch: %v", err)
+			}
+			defer w.Stop()
+
+			select {
+			case event := <-w.ResultChan():
+				got, ok := event.Object.(*corev1.Endpoints)
+				if event.Type != watch.Added || !ok || !reflect.DeepEqual(got.Subsets, e.Subsets) {
+					t.Errorf("watch event = %s %#v, want the Endpoints added", event.Type, event.Object)
+				}
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for a watch event")
+			}
+
+			if len(served) != 3 {
+				t.Errorf("served %d requests, want a get, a list and a watch", len(served))
+			}
+			for _, mediaType := range served {
+				if mediaType != tt.wantResponseType {
+					t.Errorf("served %s, want %s", mediaType, tt.wantResponseType)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceEventsWithoutLists(t *testing.T) {
+	path := setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := fake.NewSimpleClientset()
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+
+	// Reads go through the cache, so neither lists nor gets reach the API server.
+	reads := func() int {
+		var n int
+		for _, action := range clients.Actions() {
+			if action.GetVerb() == "list" || action.GetVerb() == "get" {
+				n++
+			}
+		}
+		return n
+	}
+	read := reads()
+
+	endpoints := clients.CoreV1().Endpoints("typesense")
+	steps := []struct {
+		event string
+		apply func() error
+		nodes int
+		want  string
+	}{
+		{
+			event: "added",
+			apply: func() error {
+				_, err := endpoints.Create(ctx, tsEndpoints("10.0.0.1"), metav1.CreateOptions{})
+				return err
+			},
+			nodes: 1,
+			want:  "10.0.0.1:8107:8108",
+		},
+		{
+			event: "modified",
+			apply: func() error {
+				_, err := endpoints.Update(ctx, tsEndpoints("10.0.0.2", "10.0.0.1"), metav1.UpdateOptions{})
+				return err
+			},
+			nodes: 2,
+			want:  "10.0.0.1:8107:8108,10.0.0.2:8107:8108",
+		},
+		{
+			event: "deleted",
+			apply: func() error { return endpoints.Delete(ctx, "ts", metav1.DeleteOptions{}) },
+			nodes: 0,
+			want:  "",
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the "+step.event+" event", func() bool { return sourceNodes(t, src) == step.nodes })
+
+		r.reconcile(ctx, reasonEndpoints, 1)
+		if got := readNodesFile(t, path); got != step.want {
+			t.Errorf("nodes file after %s event = %q, want %q", step.event, got, step.want)
+		}
+	}
+
+	if got := reads() - read; got != 0 {
+		t.Errorf("read from the API server %d times while handling events, want none", got)
+	}
+}
+
+// writeExtraNodes writes an extra nodes file with the given contents into a temporary directory, and
+// sets -extra-nodes to read it.
+func writeExtraNodes(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "extra-nodes")
+	if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &extraNodes, "file:"+path)
+	return path
+}
+
+func TestParseStaticNodesFile(t *testing.T) {
+	set(t, &extraNodesEnv, "")
+	writeExtraNodes(t, "\n  10.0.1.1:8107:8108 , 10.0.1.2:8107:8108\n\tts-ext.example.com:8107:8108  \n\n")
+
+	nodes, err := parseStaticNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []discovery.Endpoint{
+		{IP: "10.0.1.1", PeerPort: 8107, APIPort: 8108, Static: true},
+		{IP: "10.0.1.2", PeerPort: 8107, APIPort: 8108, Static: true},
+		{IP: "ts-ext.example.com", PeerPort: 8107, APIPort: 8108, Static: true},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("parseStaticNodes() = %v, want %v", nodes, want)
+	}
+}
+
+func TestParseStaticNodesInvalid(t *testing.T) {
+	set(t, &extraNodesEnv, "")
+
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{name: "entry", contents: "10.0.1.1:8107:8108\n10.0.1.2:8107", want: "invalid extra node"},
+		{name: "ports", contents: "10.0.1.1:peer:api", want: "invalid extra node"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeExtraNodes(t, tt.contents)
+			if _, err := parseStaticNodes(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseStaticNodes() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		set(t, &extraNodes, "file:"+filepath.Join(t.TempDir(), "missing"))
+		if _, err := parseStaticNodes(); err == nil || !strings.Contains(err.Error(), "failed to read extra nodes") {
+			t.Errorf("parseStaticNodes() = %v, want an error reading the file", err)
+		}
+	})
+}
+
+func TestParseStaticNodesEnv(t *testing.T) {
+	set(t, &extraNodes, "")
+	set(t, &extraNodesEnv, "TSNS_TEST_PEERS")
+	t.Setenv("TSNS_TEST_PEERS", "10.0.1.1:8107:8108")
+	t.Setenv("EXTRA_NODES", "10.0.1.9:8107:8108")
+
+	nodes, err := parseStaticNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []discovery.Endpoint{{IP: "10.0.1.1", PeerPort: 8107, APIPort: 8108, Static: true}}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("parseStaticNodes() = %v, want %v", nodes, want)
+	}
+
+	// The variable may name a file too, which is read again on SIGHUP like one given by the flag.
+	path := filepath.Join(t.TempDir(), "extra-nodes")
+	if err := os.WriteFile(path, []byte("10.0.1.2:8107:8108\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TSNS_TEST_PEERS", "file:"+path)
+	set(t, &staticNodes, nil)
+
+	reloadStaticNodes()
+	if want := []discovery.Endpoint{{IP: "10.0.1.2", PeerPort: 8107, APIPort: 8108, Static: true}}; !reflect.DeepEqual(staticNodes, want) {
+		t.Errorf("staticNodes after reload = %v, want %v", staticNodes, want)
+	}
+
+	// The flag takes precedence over the variable.
+	set(t, &extraNodes, "10.0.1.3:8107:8108")
+	if nodes, err = parseStaticNodes(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []discovery.Endpoint{{IP: "10.0.1.3", PeerPort: 8107, APIPort: 8108, Static: true}}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("parseStaticNodes() with the flag set = %v, want %v", nodes, want)
+	}
+}
+
+func TestReconcileReloadsStaticNodes(t *testing.T) {
+	path := setupNodesFile(t)
+	set(t, &extraNodesEnv, "")
+
+	// A bad extra nodes file was mounted, and left out the port of the second node.
+	extra := writeExtraNodes(t, "10.0.1.1:8107:8108\n")
+	nodes, err := parseStaticNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, &staticNodes, nodes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newTestReconciler(ctx, startSource(ctx, t, fake.NewSimpleClientset(tsEndpoints("10.0.0.1"))))
+	r.reconcile(ctx, reasonStartup, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.1.1:8107:8108"; got != want {
+		t.Fatalf("nodes file at startup = %q, want %q", got, want)
+	}
+
+	// The operator corrects it and sends SIGHUP.
+	if err := os.WriteFile(extra, []byte("10.0.1.1:8107:8108\n10.0.1.2:8107:8108\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r.reconcile(ctx, reasonOperator, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.1.1:8107:8108,10.0.1.2:8107:8108"; got != want {
+		t.Fatalf("nodes file after correcting the extra nodes file = %q, want %q", got, want)
+	}
+
+	// A file broken again on the next SIGHUP keeps the extra nodes already read.
+	if err := os.WriteFile(extra, []byte("10.0.1.1:8107:8108\n10.0.1.2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r.reconcile(ctx, reasonOperator, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.1.1:8107:8108,10.0.1.2:8107:8108"; got != want {
+		t.Errorf("nodes file after breaking the extra nodes file = %q, want %q", got, want)
+	}
+	if len(staticNodes) != 2 {
+		t.Errorf("staticNodes after breaking the extra nodes file = %v, want the 2 read before", staticNodes)
+	}
+}
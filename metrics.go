@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	nodesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_nodes",
+		Help: "The number of nodes in the node list last written to the nodes file.",
+	})
+
+	endpointEventsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_endpoint_events_total",
+		Help: "The number of endpoint events received.",
+	})
+
+	writesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_nodes_file_writes_total",
+		Help: "The number of times the nodes file has been written.",
+	})
+
+	writeFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_nodes_file_write_failures_total",
+		Help: "The number of times writing the nodes file has failed.",
+	})
+
+	writesSuppressedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_nodes_file_writes_suppressed_total",
+		Help: "The number of times a write of the nodes file was held back by -min-write-interval.",
+	})
+
+	degradedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_degraded",
+		Help: "Whether some of the sources couldn't be listed on the last reconcile that tried, as during an API server outage, so the nodes last found for them were used.",
+	})
+
+	webhookRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsns_webhook_requests_total",
+		Help: "The number of requests made to the -webhook-url, by response status, or error if there was no response.",
+	}, []string{"status"})
+
+	webhookFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_webhook_delivery_failures_total",
+		Help: "The number of node lists that couldn't be delivered to the -webhook-url after every attempt.",
+	})
+
+	configMapFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_configmap_publish_failures_total",
+		Help: "The number of times publishing the node list to the output ConfigMap has failed.",
+	})
+
+	externalNameFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsns_external_name_resolution_failures_total",
+		Help: "The number of times the external name of an ExternalName service failed to resolve, by service. The nodes it last resolved to are kept meanwhile.",
+	}, []string{"namespace", "service"})
+
+	notifyRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsns_notify_requests_total",
+		Help: "The number of requests made to the -notify-url, by response status, or error if there was no response.",
+	}, []string{"status"})
+
+	notifyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tsns_notify_request_duration_seconds",
+		Help:    "How long requests made to the -notify-url took.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	watchReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tsns_watch_reconnects_total",
+		Help: "The number of times the endpoints watch has failed and had to be re-established.",
+	})
+
+	tooFewNodesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_too_few_nodes",
+		Help: "Whether fewer than the minimum number of nodes were last found, so the nodes file was left as it was.",
+	})
+
+	terminatingNodesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_terminating_nodes_dropped",
+		Help: "The number of nodes last left out of the node list because their pods are terminating.",
+	})
+
+	maxNodesDroppedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_max_nodes_dropped",
+		Help: "The number of nodes last left out of the node list by -max-nodes.",
+	})
+
+	nodeSelectorDroppedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_node_selector_nodes_dropped",
+		Help: "The number of nodes last left out of the node list because the Kubernetes nodes they're on don't match -node-selector.",
+	})
+
+	bootstrapGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_bootstrapping",
+		Help: "Whether the nodes listed are those predicted from the StatefulSet, rather than those discovered.",
+	})
+
+	peerUnreachableGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsns_peer_unreachable",
+		Help: "Whether the peering port of a node couldn't be dialled on the last reconcile, by address, with -verify-peer-port.",
+	}, []string{"address"})
+
+	selfUnhealthyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_self_unhealthy",
+		Help: "Whether the local Typesense process last failed its health check, with -verify-self.",
+	})
+
+	raftStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_typesense_raft_state",
+		Help: "The local Typesense node's raft state, with -raft-poll-interval: 1 leader, 2 transferring, 3 candidate, 4 follower, 5 error, 6 uninitialized, 7 shutting down, 8 shutdown, or -1 if unknown.",
+	})
+
+	raftCommittedIndexGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tsns_typesense_raft_committed_index",
+		Help: "The index of the last raft log entry the local Typesense node knows to be committed, with -raft-poll-interval.",
+	})
+
+	secondsSinceWriteGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tsns_seconds_since_last_write",
+		Help: "The number of seconds since the nodes file was last written, or -1 if it hasn't been.",
+	}, lastWrite.secondsSince)
+
+	secondsSinceNodesSeenGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tsns_seconds_since_nodes_seen",
+		Help: "The number of seconds since any nodes were last discovered, or since startup if none have been.",
+	}, nodesSeen.secondsSince)
+)
+
+// lastWrite holds the time the nodes file was last written.
+var lastWrite lastWriteTime
+
+// nodesSeen holds the time any nodes were last discovered, not counting static or predicted nodes,
+// or the time tsns started if none have been. It's set up by run.
+var nodesSeen lastWriteTime
+
+// lastWriteTime is a time that's safe to set and read concurrently.
+type lastWriteTime struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// set records t as the time of the last write.
+func (l *lastWriteTime) set(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.t = t
+}
+
+// secondsSince returns the number of seconds since the last write, or -1 if there hasn't been one.
+func (l *lastWriteTime) secondsSince() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.t.IsZero() {
+		return -1
+	}
+
+	return time.Since(l.t).Seconds()
+}
+
+// since returns the time since the last write, or zero if there hasn't been one.
+func (l *lastWriteTime) since() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.t.IsZero() {
+		return 0
+	}
+
+	return time.Since(l.t)
+}
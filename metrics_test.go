@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+	"k8s.io/client-go/kubernetes/fake"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// scrape returns the metrics served by the metrics endpoint, by name.
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics endpoint responded %d", rec.Code)
+	}
+
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(map[string]float64)
+	for _, line := range strings.Split(string(body), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if !ok || strings.HasPrefix(line, "#") || !strings.HasPrefix(name, "tsns_") {
+			continue
+		}
+		if metrics[name], err = strconv.ParseFloat(value, 64); err != nil {
+			t.Fatalf("metric %s has invalid value %q", name, value)
+		}
+	}
+
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	path := setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := scrape(t)
+
+	// A write of one node, then an update to the Endpoints that's handled as run handles it, with a
+	// write of two nodes, then a failed write, then a watch that ended and was re-established.
+	clients := fake.NewSimpleClientset(tsEndpoints("10.0.0.1"))
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+	r.synced = src.informer.HasSynced
+	r.reconcile(ctx, reasonStartup, 0)
+
+	// The handler is told of the Endpoints already in the cache as it's added, then of the update.
+	src.informer.AddEventHandler(sourceEventHandler(func(reason string) { r.notify(ctx, reason) }, func(_, _ interface{}) {}))
+	if _, err := clients.CoreV1().Endpoints("typesense").Update(ctx, tsEndpoints("10.0.0.1", "10.0.0.2"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case reason := <-r.events:
+			r.reconcile(ctx, reason, 1)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reconcile asked for by the endpoint events")
+		}
+	}
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file after the update = %q, want %q", got, want)
+	}
+
+	missing := filepath.Join(filepath.Dir(path), "missing", "nodes")
+	set(t, &nodesTargets, []*nodesTarget{newFileTarget(nodesfile.Writer{Path: missing, UID: -1, GID: -1, Attempts: 1, NoSync: true}, false)})
+	if _, err := writeNodes(ctx, nil, "10.0.0.1:8107:8108", reasonEndpoints); err == nil {
+		t.Fatal("write into a missing directory succeeded")
+	}
+
+	handleWatchError(nil, io.EOF)
+
+	after := scrape(t)
+	if got := after["tsns_bootstrapping"]; got != 0 {
+		t.Errorf("tsns_bootstrapping = %v with nodes discovered, want 0", got)
+	}
+
+	for _, name := range []string{
+		"tsns_nodes",
+		"tsns_endpoint_events_total",
+		"tsns_nodes_file_writes_total",
+		"tsns_nodes_file_write_failures_total",
+		"tsns_seconds_since_last_write",
+		"tsns_watch_reconnects_total",
+		"tsns_bootstrapping",
+	} {
+		if _, ok := after[name]; !ok {
+			t.Errorf("metric %s not served", name)
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"tsns_endpoint_events_total":           2,
+		"tsns_nodes_file_writes_total":         2,
+		"tsns_nodes_file_write_failures_total": 1,
+		"tsns_watch_reconnects_total":          1,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %v, want %v", name, got, want)
+		}
+	}
+
+	if got := after["tsns_nodes"]; got != 2 {
+		t.Errorf("tsns_nodes = %v, want 2", got)
+	}
+	if got := after["tsns_seconds_since_last_write"]; got < 0 {
+		t.Errorf("tsns_seconds_since_last_write = %v after a write, want at least 0", got)
+	}
+}
+
+func TestMetricsBootstrapping(t *testing.T) {
+	setupNodesFile(t)
+	set(t, &bootstrapFromStatefulSet, true)
+	set(t, &bootstrapHandover, 1)
+	set(t, &bootstrapSince, time.Time{})
+	set(t, &bootstrapSize, 0)
+	setBootstrapping(false)
+	t.Cleanup(func() { setBootstrapping(false) })
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"},
+		Spec:       appsv1.StatefulSetSpec{ServiceName: "ts"},
+	}
+	get := func() (*appsv1.StatefulSet, error) { return sts, nil }
+
+	// With no nodes discovered, the nodes are predicted from the StatefulSet.
+	if _, err := bootstrapNodes(context.Background(), nil, get); err != nil {
+		t.Fatal(err)
+	}
+	if got := scrape(t)["tsns_bootstrapping"]; got != 1 {
+		t.Errorf("tsns_bootstrapping while bootstrapping = %v, want 1", got)
+	}
+
+	if _, err := bootstrapNodes(context.Background(), []discovery.Endpoint{{IP: "10.0.0.1"}}, get); err != nil {
+		t.Fatal(err)
+	}
+	if got := scrape(t)["tsns_bootstrapping"]; got != 0 {
+		t.Errorf("tsns_bootstrapping once enough nodes are discovered = %v, want 0", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// recoveryCheckInterval is how often an API server that couldn't be listed from is checked, to find
+// out as soon as it's back.
+const recoveryCheckInterval = 5 * time.Second
+
+// recoveryChecks holds, by cluster, a channel for each API server being checked by awaitRecovery,
+// which is closed once the check is done.
+type recoveryChecks map[string]<-chan struct{}
+
+// start starts checking the API server of the named cluster with awaitRecovery, unless it's already
+// being checked.
+func (r recoveryChecks) start(ctx context.Context, cluster string, clients kubernetes.Interface, events chan<- string) {
+	if done, ok := r[cluster]; ok {
+		select {
+		case <-done:
+		default:
+			return
+		}
+	}
+
+	r[cluster] = awaitRecovery(ctx, cluster, clients, events)
+}
+
+// awaitRecovery checks the API server behind clients every recoveryCheckInterval until it can be
+// reached again, then sends reasonRecovered to events, so that everything is listed again with a full
+// reconcile straight away rather than at the next periodic one. The returned channel is closed once
+// it's done, or ctx is.
+func awaitRecovery(ctx context.Context, cluster string, clients kubernetes.Interface, events chan<- string) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-time.After(recoveryCheckInterval):
+			case <-ctx.Done():
+				return
+			}
+
+			checkCtx, cancel := context.WithTimeout(ctx, recoveryCheckInterval)
+			err := clients.Discovery().RESTClient().Get().AbsPath("/version").Do(checkCtx).Error()
+			cancel()
+
+			if err == nil {
+				break
+			}
+
+			slog.Debug("api server still unreachable", "cluster", cluster, "error", err)
+		}
+
+		select {
+		case events <- reasonRecovered:
+		case <-ctx.Done():
+		}
+	}()
+
+	return done
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+// jsonDocument is the document written in the JSON format.
+type jsonDocument struct {
+	// GeneratedAt is when the document was written, and Generation the number of times it has been
+	// written with a changed node list, which increases by one each time.
+	GeneratedAt time.Time `json:"generated_at"`
+	Generation  int       `json:"generation"`
+
+	// Source is the kind of object the nodes were discovered from.
+	Source string `json:"source"`
+
+	Nodes []discovery.Node `json:"nodes"`
+}
+
+// renderJSON returns the JSON document for the nodes at the given addresses, to be written to the
+// given file. The generation follows on from that of the document already in the file, if any, so
+// that it keeps increasing across restarts.
+func renderJSON(path string, addresses []discovery.Endpoint) (string, error) {
+	var previous jsonDocument
+	if b, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(b, &previous)
+	}
+
+	b, err := json.MarshalIndent(jsonDocument{
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Generation:  previous.Generation + 1,
+		Source:      sourceKind(),
+		Nodes:       nodeOptions.Nodes(addresses),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(b) + "\n", nil
+}
+
+// sourceKind returns the kind of object nodes are discovered from.
+func sourceKind() string {
+	switch {
+	case discoveryMode == "pods" || discoveryMode == "dns":
+		return discoveryMode
+	case useEndpointSlices:
+		return "endpointslices"
+	default:
+		return "endpoints"
+	}
+}
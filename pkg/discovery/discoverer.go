@@ -0,0 +1,218 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Discoverer discovers the Typesense nodes behind a single service, in the same way as tsns, for
+// programs that want the node list without running the sidecar. For example:
+//
+//	d := &discovery.Discoverer{
+//		Client:    clients,
+//		Namespace: "search",
+//		Service:   "typesense",
+//		Options:   discovery.Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"},
+//	}
+//
+//	err := d.Watch(ctx, func(nodes []discovery.Node) {
+//		log.Printf("typesense nodes: %v", nodes)
+//	})
+type Discoverer struct {
+	// Client is the client to the API server the service is in.
+	Client kubernetes.Interface
+
+	// Namespace and Service name the service to discover the nodes of.
+	Namespace string
+	Service   string
+
+	// Options is how the nodes are discovered and listed.
+	Options Options
+
+	// UseEndpointSlices discovers nodes from the service's EndpointSlices instead of its Endpoints.
+	UseEndpointSlices bool
+
+	// Resync is how often Watch calls back with the nodes even if they haven't changed, or never if
+	// zero.
+	Resync time.Duration
+}
+
+// Nodes returns the service's nodes, deduplicated and sorted, as listed from the API server. A
+// service that doesn't exist has no nodes.
+func (d *Discoverer) Nodes(ctx context.Context) ([]Node, error) {
+	addresses, err := d.Endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.nodes(addresses), nil
+}
+
+// Endpoints returns the addresses of the service's endpoints as listed from the API server, before
+// they're deduplicated. A service that doesn't exist has none.
+func (d *Discoverer) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	if d.UseEndpointSlices {
+		options := metav1.ListOptions{}
+		d.TweakListOptions(&options)
+
+		list, err := d.Client.DiscoveryV1().EndpointSlices(d.Namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		slices := make([]*discoveryv1.EndpointSlice, 0, len(list.Items))
+		for i := range list.Items {
+			slices = append(slices, &list.Items[i])
+		}
+
+		return d.Options.FromEndpointSlices(slices), nil
+	}
+
+	e, err := d.Client.CoreV1().Endpoints(d.Namespace).Get(ctx, d.Service, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Options.FromEndpoints([]*corev1.Endpoints{e}), nil
+}
+
+// nodes returns the nodes at the given addresses, leaving out those that aren't ready if there
+// are enough that are.
+func (d *Discoverer) nodes(addresses []Endpoint) []Node {
+	return d.Options.Nodes(d.Options.LimitNotReady(d.Options.Dedupe(addresses)))
+}
+
+// Watch watches the service, calling fn with its nodes once they've first been listed, and again
+// each time they change, until ctx is done. fn is never called concurrently.
+func (d *Discoverer) Watch(ctx context.Context, fn func([]Node)) error {
+	c := d.NewCache()
+
+	var last string
+	notify := func(force bool) {
+		addresses, err := c.Endpoints()
+		if err != nil {
+			return
+		}
+
+		// The file contents make a handy key for telling whether the nodes have changed.
+		addresses = d.Options.LimitNotReady(d.Options.Dedupe(addresses))
+		if key := d.Options.Format(addresses); force || key != last {
+			last = key
+			fn(d.Options.Nodes(addresses))
+		}
+	}
+
+	// Changes are passed along a channel to be handled here, one at a time, so that fn is only ever
+	// called from this goroutine. Changes that come in while one is being handled are coalesced.
+	changed := make(chan bool, 1)
+	signal := func(force bool) {
+		select {
+		case changed <- force:
+		default:
+		}
+	}
+
+	c.Informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { signal(false) },
+		UpdateFunc: func(old, new interface{}) {
+			// Resyncs are delivered as updates where nothing has changed.
+			signal(old.(metav1.Object).GetResourceVersion() == new.(metav1.Object).GetResourceVersion())
+		},
+		DeleteFunc: func(interface{}) { signal(false) },
+	})
+
+	c.Factory.Start(ctx.Done())
+
+	// The cache only fails to sync if ctx is done first.
+	if !cache.WaitForCacheSync(ctx.Done(), c.Informer.HasSynced) {
+		return ctx.Err()
+	}
+
+	notify(true)
+
+	for {
+		select {
+		case force := <-changed:
+			notify(force)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Cache is an informer caching the service's Endpoints or EndpointSlices, for programs that want to
+// handle its events themselves rather than through Watch.
+type Cache struct {
+	// Factory is the informer factory that must be started for the informer to run.
+	Factory informers.SharedInformerFactory
+
+	// Informer is the informer, to add event handlers to and wait for the sync of.
+	Informer cache.SharedIndexInformer
+
+	list func() ([]Endpoint, error)
+}
+
+// Endpoints returns the addresses of the service's endpoints in the cache, before they're
+// deduplicated.
+func (c *Cache) Endpoints() ([]Endpoint, error) {
+	return c.list()
+}
+
+// NewCache returns a cache of the service's Endpoints or EndpointSlices. Watch watches the service
+// through one.
+func (d *Discoverer) NewCache() *Cache {
+	factory := informers.NewSharedInformerFactoryWithOptions(d.Client, d.Resync,
+		informers.WithNamespace(d.Namespace),
+		informers.WithTweakListOptions(d.TweakListOptions),
+	)
+
+	if d.UseEndpointSlices {
+		slices := factory.Discovery().V1().EndpointSlices()
+		lister := slices.Lister().EndpointSlices(d.Namespace)
+
+		return &Cache{Factory: factory, Informer: slices.Informer(), list: func() ([]Endpoint, error) {
+			items, err := lister.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			return d.Options.FromEndpointSlices(items), nil
+		}}
+	}
+
+	endpoints := factory.Core().V1().Endpoints()
+	lister := endpoints.Lister().Endpoints(d.Namespace)
+
+	return &Cache{Factory: factory, Informer: endpoints.Informer(), list: func() ([]Endpoint, error) {
+		e, err := lister.Get(d.Service)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return d.Options.FromEndpoints([]*corev1.Endpoints{e}), nil
+	}}
+}
+
+// TweakListOptions restricts list and watch requests to the service's Endpoints or EndpointSlices.
+func (d *Discoverer) TweakListOptions(options *metav1.ListOptions) {
+	if d.UseEndpointSlices {
+		options.LabelSelector = labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: d.Service}).String()
+	} else {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", d.Service).String()
+	}
+}
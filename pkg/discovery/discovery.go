@@ -0,0 +1,270 @@
+// Package discovery converts the endpoints of Typesense services into the nodes to list in the
+// Typesense nodes file. It's what tsns discovers nodes with, and can be used on its own, through a
+// Discoverer, by programs that want the same node list without running the sidecar. The nodesfile
+// package writes the list out.
+//
+// The module is versioned v0.x, so its exported API may still change between minor versions, as
+// noted in CHANGELOG.md. Depend on a tagged release rather than a commit.
+package discovery
+
+import (
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// Endpoint is an address of a service, along with the name of the pod behind it, if known, or a
+// static node given outside Kubernetes.
+type Endpoint struct {
+	// Cluster is the name of the remote cluster the endpoint was discovered in, or empty for the
+	// local cluster.
+	Cluster   string
+	Namespace string
+	Service   string
+
+	// IP is the address of the endpoint. For a static node it may be a host name instead.
+	IP string
+
+	// Hostname is the stable name of the pod behind the endpoint within its service, and Pod the
+	// name of the pod itself, if known. Subdomain is the service the hostname is under when that
+	// isn't Service, as for a pod whose subdomain is another headless service.
+	Hostname  string
+	Subdomain string
+	Pod       string
+
+	// NodeName is the Kubernetes node the endpoint is on, and Zone the zone that's in, if known.
+	NodeName string
+	Zone     string
+
+	// NotReady is set for an endpoint that isn't ready, which is only listed when not ready nodes
+	// are being included.
+	NotReady bool
+
+	Static   bool
+	PeerPort int
+	APIPort  int
+}
+
+// Options controls how endpoints are converted into nodes.
+type Options struct {
+	// PeerPort and APIPort are the ports to list nodes with. If PeerPortName or APIPortName are set,
+	// the ports with those names are used instead where the endpoints have them.
+	PeerPort     int
+	APIPort      int
+	PeerPortName string
+	APIPortName  string
+
+	// IPFamily is the IP family, ipv4 or ipv6, to list nodes with when endpoints have addresses in
+	// both.
+	IPFamily string
+
+	// IncludeNotReady lists nodes whose endpoints aren't ready too. If IncludeNotReadyBelow is also
+	// set, LimitNotReady only keeps them while fewer nodes than that are ready.
+	IncludeNotReady      bool
+	IncludeNotReadyBelow int
+
+	// UseHostnames lists nodes by their stable pod DNS names instead of their IPs, where known. With
+	// PublishedHostnamesOnly, that's only where the endpoint gives a hostname, so has a DNS record
+	// under the service, rather than also falling back to the pod's name.
+	UseHostnames           bool
+	PublishedHostnamesOnly bool
+
+	// SortByPod orders nodes by their pods, as by ComparePods, rather than by their hosts.
+	SortByPod bool
+
+	// ClusterDomain is the cluster's DNS domain that pod DNS names are under, cluster.local if empty.
+	ClusterDomain string
+
+	// TerminatingGrace is how long a pod may be terminating for before it's no longer listed, when
+	// nodes are discovered from pods.
+	TerminatingGrace time.Duration
+}
+
+// FromEndpoints returns the nodes listed in the given Endpoints.
+func (o *Options) FromEndpoints(endpoints []*corev1.Endpoints) []Endpoint {
+	var ready, notReady []Endpoint
+
+	for _, e := range endpoints {
+		for _, s := range e.Subsets {
+			named := make(map[string]int32, len(s.Ports))
+			for _, p := range s.Ports {
+				named[p.Name] = p.Port
+			}
+
+			peer, api := o.portsFor(named)
+
+			for _, a := range s.Addresses {
+				ready = append(ready, o.newEndpoint(e, a, peer, api))
+			}
+			for _, a := range s.NotReadyAddresses {
+				ep := o.newEndpoint(e, a, peer, api)
+				ep.NotReady = true
+				notReady = append(notReady, ep)
+			}
+		}
+	}
+
+	return o.withNotReady(o.preferFamily(ready), o.preferFamily(notReady))
+}
+
+// newEndpoint returns the endpoint for an address in the given Endpoints, with the given ports.
+func (o *Options) newEndpoint(e *corev1.Endpoints, a corev1.EndpointAddress, peerPort, apiPort int) Endpoint {
+	var pod string
+	if a.TargetRef != nil && a.TargetRef.Kind == "Pod" {
+		pod = a.TargetRef.Name
+	}
+
+	hostname := a.Hostname
+	if hostname == "" && !o.PublishedHostnamesOnly {
+		hostname = pod
+	}
+
+	var node string
+	if a.NodeName != nil {
+		node = *a.NodeName
+	}
+
+	return Endpoint{Namespace: e.Namespace, Service: e.Name, IP: a.IP, Hostname: hostname, Pod: pod, NodeName: node, PeerPort: peerPort, APIPort: apiPort}
+}
+
+// FromEndpointSlices returns the nodes listed in the given EndpointSlices. A service may be split
+// over many slices, and the same address may appear in more than one of them. Endpoints that are
+// explicitly not ready are skipped, unless not ready nodes are being included, and terminating
+// endpoints are always skipped.
+func (o *Options) FromEndpointSlices(slices []*discoveryv1.EndpointSlice) []Endpoint {
+	var ready, notReady []Endpoint
+
+	for _, s := range slices {
+		named := make(map[string]int32, len(s.Ports))
+		for _, p := range s.Ports {
+			if p.Name != nil && p.Port != nil {
+				named[*p.Name] = *p.Port
+			}
+		}
+
+		peer, api := o.portsFor(named)
+		svc := s.Labels[discoveryv1.LabelServiceName]
+
+		for _, e := range s.Endpoints {
+			if e.Conditions.Terminating != nil && *e.Conditions.Terminating {
+				continue
+			}
+
+			var pod string
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				pod = e.TargetRef.Name
+			}
+
+			var hostname string
+			if !o.PublishedHostnamesOnly {
+				hostname = pod
+			}
+			if e.Hostname != nil {
+				hostname = *e.Hostname
+			}
+
+			var node, zone string
+			if e.NodeName != nil {
+				node = *e.NodeName
+			}
+			if e.Zone != nil {
+				zone = *e.Zone
+			}
+
+			for _, a := range e.Addresses {
+				ep := Endpoint{Namespace: s.Namespace, Service: svc, IP: a, Hostname: hostname, Pod: pod, NodeName: node, Zone: zone, PeerPort: peer, APIPort: api}
+
+				// A nil ready condition means the state is unknown, which should be treated as ready.
+				if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+					ep.NotReady = true
+					notReady = append(notReady, ep)
+				} else {
+					ready = append(ready, ep)
+				}
+			}
+		}
+	}
+
+	return o.withNotReady(o.preferFamily(ready), o.preferFamily(notReady))
+}
+
+// withNotReady returns the ready nodes, followed by the not ready nodes if they're being included.
+// Whether there are few enough ready nodes to keep them is only known once the nodes of every
+// service have been deduplicated, so that's left to LimitNotReady.
+func (o *Options) withNotReady(ready, notReady []Endpoint) []Endpoint {
+	if !o.IncludeNotReady {
+		return ready
+	}
+
+	return append(ready, notReady...)
+}
+
+// LimitNotReady returns the given nodes less those that aren't ready, if IncludeNotReadyBelow is set
+// and at least that many of them are ready, so that not ready nodes are only listed while a forming
+// cluster needs them to find its peers. Ready nodes are counted by their distinct entries, so the
+// nodes should be those of every service together, deduplicated first.
+func (o *Options) LimitNotReady(nodes []Endpoint) []Endpoint {
+	if o.IncludeNotReadyBelow <= 0 {
+		return nodes
+	}
+
+	ready := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if !n.NotReady {
+			ready[FormatNode(o.Host(n), n.PeerPort, n.APIPort)] = true
+		}
+	}
+
+	if len(ready) < o.IncludeNotReadyBelow {
+		return nodes
+	}
+
+	kept := nodes[:0:0]
+	for _, n := range nodes {
+		if !n.NotReady {
+			kept = append(kept, n)
+		}
+	}
+
+	return kept
+}
+
+// portsFor returns the peer and API ports for addresses exposing the given named ports. When port
+// names are configured they're looked up by name, falling back to the configured port numbers if a
+// name isn't found.
+func (o *Options) portsFor(named map[string]int32) (int, int) {
+	peer, api := o.PeerPort, o.APIPort
+
+	if p, ok := named[o.PeerPortName]; ok && o.PeerPortName != "" {
+		peer = int(p)
+	}
+	if p, ok := named[o.APIPortName]; ok && o.APIPortName != "" {
+		api = int(p)
+	}
+
+	return peer, api
+}
+
+// preferFamily returns only the addresses belonging to the preferred IP family, as long as there
+// are any. A dual-stack service has endpoints for each pod in both families, and a node must only
+// be listed once. Addresses that aren't IPs are always kept.
+func (o *Options) preferFamily(addresses []Endpoint) []Endpoint {
+	var preferred, other []Endpoint
+
+	for _, a := range addresses {
+		ip := net.ParseIP(a.IP)
+		if ip == nil || (ip.To4() == nil) == (o.IPFamily == "ipv6") {
+			preferred = append(preferred, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+
+	if len(preferred) == 0 {
+		return other
+	}
+
+	return preferred
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podAddress returns an endpoint address at the given IP for the given pod.
+func podAddress(ip, pod string) corev1.EndpointAddress {
+	return corev1.EndpointAddress{IP: ip, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod}}
+}
+
+func TestFromEndpointsSubsetsSharingAddresses(t *testing.T) {
+	o := Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"}
+
+	// A service with several ports has a subset per set of ports, each repeating the same addresses.
+	e := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "search", Name: "ts"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{podAddress("10.0.0.1", "ts-0"), podAddress("10.0.0.2", "ts-1")},
+				Ports:     []corev1.EndpointPort{{Name: "http", Port: 8108}},
+			},
+			{
+				Addresses: []corev1.EndpointAddress{podAddress("10.0.0.2", "ts-1"), podAddress("10.0.0.1", "ts-0")},
+				Ports:     []corev1.EndpointPort{{Name: "peering", Port: 8107}},
+			},
+		},
+	}
+
+	nodes := o.FromEndpoints([]*corev1.Endpoints{e})
+	if len(nodes) != 4 {
+		t.Fatalf("FromEndpoints() = %d nodes, want one per address of each subset, 4", len(nodes))
+	}
+
+	if got := o.Dedupe(nodes); len(got) != 2 {
+		t.Errorf("Dedupe() = %v, want 2 nodes", got)
+	}
+
+	if got, want := o.Format(nodes), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
+
+func TestFromEndpointsHostnames(t *testing.T) {
+	// Only some addresses have hostnames, as when a StatefulSet's pods are behind the service
+	// alongside others. One address has a pod but no hostname, and one has neither.
+	e := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "search", Name: "ts"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{
+					{IP: "10.0.0.1", Hostname: "ts-0", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "ts-0"}},
+					podAddress("10.0.0.2", "other-abcde"),
+				},
+			},
+			{
+				Addresses: []corev1.EndpointAddress{
+					{IP: "10.0.0.3", Hostname: "ts-1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "ts-1"}},
+					{IP: "10.0.0.4"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		options Options
+		want    string
+	}{
+		{
+			name:    "IPs",
+			options: Options{PeerPort: 8107, APIPort: 8108},
+			want:    "10.0.0.1:8107:8108,10.0.0.2:8107:8108,10.0.0.3:8107:8108,10.0.0.4:8107:8108",
+		},
+		{
+			name:    "hostnames",
+			options: Options{PeerPort: 8107, APIPort: 8108, UseHostnames: true},
+			want:    "10.0.0.4:8107:8108,other-abcde.ts.search.svc.cluster.local:8107:8108,ts-0.ts.search.svc.cluster.local:8107:8108,ts-1.ts.search.svc.cluster.local:8107:8108",
+		},
+		{
+			name:    "published hostnames only",
+			options: Options{PeerPort: 8107, APIPort: 8108, UseHostnames: true, PublishedHostnamesOnly: true},
+			want:    "10.0.0.2:8107:8108,10.0.0.4:8107:8108,ts-0.ts.search.svc.cluster.local:8107:8108,ts-1.ts.search.svc.cluster.local:8107:8108",
+		},
+		{
+			name:    "cluster domain",
+			options: Options{PeerPort: 8107, APIPort: 8108, UseHostnames: true, PublishedHostnamesOnly: true, ClusterDomain: "example.internal"},
+			want:    "10.0.0.2:8107:8108,10.0.0.4:8107:8108,ts-0.ts.search.svc.example.internal:8107:8108,ts-1.ts.search.svc.example.internal:8107:8108",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.Format(tt.options.FromEndpoints([]*corev1.Endpoints{e})); got != tt.want {
+				t.Errorf("Format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/client-go/kubernetes/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// endpoints returns the Endpoints of a three node Typesense service.
+func endpoints() *corev1.Endpoints {
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "search", Name: "typesense"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.3"},
+				{IP: "10.0.0.1"},
+				{IP: "10.0.0.2"},
+			},
+		}},
+	}
+}
+
+func ExampleDiscoverer_Nodes() {
+	d := &discovery.Discoverer{
+		Client:    fake.NewSimpleClientset(endpoints()),
+		Namespace: "search",
+		Service:   "typesense",
+		Options:   discovery.Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"},
+	}
+
+	nodes, err := d.Nodes(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, n := range nodes {
+		fmt.Println(n.Entry)
+	}
+	// Output:
+	// 10.0.0.1:8107:8108
+	// 10.0.0.2:8107:8108
+	// 10.0.0.3:8107:8108
+}
+
+func ExampleDiscoverer_Watch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &discovery.Discoverer{
+		Client:    fake.NewSimpleClientset(endpoints()),
+		Namespace: "search",
+		Service:   "typesense",
+		Options:   discovery.Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"},
+	}
+
+	// Watch calls back with the nodes once they've first been listed. Stop after that.
+	err := d.Watch(ctx, func(nodes []discovery.Node) {
+		fmt.Println(len(nodes), "nodes")
+		cancel()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// 3 nodes
+}
+
+func ExampleDiscoverer_NewCache() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &discovery.Discoverer{
+		Client:    fake.NewSimpleClientset(endpoints()),
+		Namespace: "search",
+		Service:   "typesense",
+		Options:   discovery.Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"},
+	}
+
+	c := d.NewCache()
+	c.Factory.Start(ctx.Done())
+	c.Factory.WaitForCacheSync(ctx.Done())
+
+	addresses, err := c.Endpoints()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(d.Options.Format(addresses))
+	// Output:
+	// 10.0.0.1:8107:8108,10.0.0.2:8107:8108,10.0.0.3:8107:8108
+}
@@ -0,0 +1,262 @@
+package discovery
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format returns the nodes file contents for the Typesense nodes at the given addresses. The nodes
+// are deduplicated and sorted, so the same set of nodes always produces the same contents. Nodes
+// with the same entry, as for pods with the same ports on the same host, are only written once.
+func (o *Options) Format(addresses []Endpoint) string {
+	addresses = o.Sort(o.Dedupe(addresses))
+
+	nodes := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		entry := FormatNode(o.Host(a), a.PeerPort, a.APIPort)
+		if slices.Contains(nodes, entry) {
+			continue
+		}
+
+		nodes = append(nodes, entry)
+	}
+
+	return strings.Join(nodes, ",")
+}
+
+// Dedupe returns the given nodes with any that share a host with an earlier node for the same pod
+// removed. The same address appears once per subset when a service has several ports, and may also
+// appear in several EndpointSlices. Nodes for different pods on the same host, as with hostNetwork
+// pods on the same Kubernetes node, are kept, as they may be told apart by their ports. A node whose
+// pod isn't known, such as a static node, is taken to be the same as any other on its host. A node
+// that's ready takes the place of an earlier one that isn't, as for a pod behind two services that's
+// only ready in one. Nodes with no host at all are removed too, as they'd be written as a malformed
+// entry like :8107:8108.
+func (o *Options) Dedupe(nodes []Endpoint) []Endpoint {
+	seen := make(map[string][]int, len(nodes))
+	deduped := make([]Endpoint, 0, len(nodes))
+
+	for _, n := range nodes {
+		host := o.Host(n)
+		if host == "" {
+			continue
+		}
+
+		i := slices.IndexFunc(seen[host], func(i int) bool { return samePod(deduped[i], n) })
+		if i >= 0 {
+			if kept := seen[host][i]; deduped[kept].NotReady && !n.NotReady {
+				deduped[kept] = n
+			}
+			continue
+		}
+
+		seen[host] = append(seen[host], len(deduped))
+		deduped = append(deduped, n)
+	}
+
+	return deduped
+}
+
+// samePod reports whether two nodes are for the same pod, or either's pod isn't known.
+func samePod(a, b Endpoint) bool {
+	return a.Pod == "" || b.Pod == "" || a.Cluster == b.Cluster && a.Namespace == b.Namespace && a.Pod == b.Pod
+}
+
+// Sort returns a sorted copy of the given nodes. With SortByPod, nodes are ordered by their pods
+// first, as by ComparePods. Otherwise, or for nodes without pods, nodes listed by IP are ordered
+// numerically, ahead of those listed by name, which are ordered lexicographically. Nodes on the same
+// host are ordered by their ports.
+func (o *Options) Sort(nodes []Endpoint) []Endpoint {
+	sorted := append([]Endpoint(nil), nodes...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+
+		if o.SortByPod {
+			if c := ComparePods(a, b); c != 0 {
+				return c < 0
+			}
+		}
+
+		hostA, hostB := o.Host(a), o.Host(b)
+
+		if hostA != hostB {
+			ipA, errA := netip.ParseAddr(hostA)
+			ipB, errB := netip.ParseAddr(hostB)
+
+			switch {
+			case errA == nil && errB == nil:
+				return ipA.Less(ipB)
+			case errA == nil || errB == nil:
+				return errA == nil
+			default:
+				return hostA < hostB
+			}
+		}
+
+		if a.PeerPort != b.PeerPort {
+			return a.PeerPort < b.PeerPort
+		}
+
+		return a.APIPort < b.APIPort
+	})
+
+	return sorted
+}
+
+// ComparePods compares nodes by their pods, returning -1, 0 or 1 as for cmp.Compare. Nodes with pods
+// come first, ordered by cluster, namespace and then pod name, with the ordinals of StatefulSet pods
+// compared as numbers, so that ts-10 comes after ts-9. Nodes without pods compare equal.
+func ComparePods(a, b Endpoint) int {
+	if (a.Pod == "") != (b.Pod == "") {
+		if a.Pod == "" {
+			return 1
+		}
+		return -1
+	}
+
+	baseA, ordinalA := PodOrdinal(a.Pod)
+	baseB, ordinalB := PodOrdinal(b.Pod)
+
+	return cmp.Or(
+		cmp.Compare(a.Cluster, b.Cluster),
+		cmp.Compare(a.Namespace, b.Namespace),
+		cmp.Compare(baseA, baseB),
+		cmp.Compare(ordinalA, ordinalB),
+		cmp.Compare(a.Pod, b.Pod),
+	)
+}
+
+// PodOrdinal splits a pod name of the form <statefulset>-<ordinal> into the StatefulSet's name and
+// the ordinal, or returns the whole name and -1 if it doesn't end in an ordinal.
+func PodOrdinal(name string) (string, int) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return name, -1
+	}
+
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if err != nil || ordinal < 0 {
+		return name, -1
+	}
+
+	return name[:i], ordinal
+}
+
+// Host returns the host to list a node under. That is its pod IP, unless hostnames are being used
+// and the pod's name is known, in which case it's the pod's stable DNS name.
+func (o *Options) Host(a Endpoint) string {
+	if o.UseHostnames && a.Hostname != "" {
+		return fmt.Sprintf("%s.%s.%s.svc.%s", a.Hostname, cmp.Or(a.Subdomain, a.Service), a.Namespace, cmp.Or(o.ClusterDomain, "cluster.local"))
+	}
+
+	return a.IP
+}
+
+// FormatNode returns the nodes file entry for the Typesense node at the given host and ports. IPv6
+// addresses are bracketed so that the address can be told apart from the ports.
+func FormatNode(host string, peerPort, apiPort int) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	return fmt.Sprintf("%s:%d:%d", host, peerPort, apiPort)
+}
+
+// ParseNode returns the static node for a nodes file entry, of the form host:peer:api. An IPv6 host
+// must be bracketed.
+func ParseNode(entry string) (Endpoint, error) {
+	host, ports, ok := strings.Cut(entry, "]:")
+	if ok && strings.HasPrefix(host, "[") {
+		host = host[1:]
+	} else if i := strings.Index(entry, ":"); i >= 0 {
+		host, ports = entry[:i], entry[i+1:]
+	} else {
+		return Endpoint{}, fmt.Errorf("%q isn't of the form host:peer:api", entry)
+	}
+
+	peer, api, ok := strings.Cut(ports, ":")
+	if host == "" || !ok {
+		return Endpoint{}, fmt.Errorf("%q isn't of the form host:peer:api", entry)
+	}
+
+	peerPort, err := strconv.ParseUint(peer, 10, 16)
+	if err != nil || peerPort == 0 {
+		return Endpoint{}, fmt.Errorf("%q has an invalid peer port", entry)
+	}
+
+	apiPort, err := strconv.ParseUint(api, 10, 16)
+	if err != nil || apiPort == 0 {
+		return Endpoint{}, fmt.Errorf("%q has an invalid API port", entry)
+	}
+
+	return Endpoint{IP: host, Static: true, PeerPort: int(peerPort), APIPort: int(apiPort)}, nil
+}
+
+// Count returns the number of entries in the node list.
+func Count(nodes string) int {
+	if nodes == "" {
+		return 0
+	}
+
+	return strings.Count(nodes, ",") + 1
+}
+
+// Canonical returns the node list with its entries sorted, so that two lists containing the same
+// nodes in a different order compare equal.
+func Canonical(nodes string) string {
+	entries := strings.Split(strings.TrimSpace(nodes), ",")
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Diff returns the entries of one node list that aren't in a previous one, the entries of the
+// previous one that aren't in it, and the number of entries in both. Entries are compared as
+// parsed, so neither their order nor how their hosts are written matters.
+func Diff(previous, nodes string) (added, removed []string, unchanged int) {
+	before, after := entrySet(previous), entrySet(nodes)
+
+	for e := range after {
+		if before[e] {
+			unchanged++
+		} else {
+			added = append(added, e)
+		}
+	}
+	for e := range before {
+		if !after[e] {
+			removed = append(removed, e)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, unchanged
+}
+
+// entrySet returns the entries of a node list as a set, in their normal form. Entries that can't be
+// parsed are kept as they are.
+func entrySet(nodes string) map[string]bool {
+	set := make(map[string]bool)
+	for _, e := range strings.Split(strings.TrimSpace(nodes), ",") {
+		if e == "" {
+			continue
+		}
+
+		if n, err := ParseNode(e); err == nil {
+			if ip, err := netip.ParseAddr(n.IP); err == nil {
+				n.IP = ip.String()
+			}
+			e = FormatNode(n.IP, n.PeerPort, n.APIPort)
+		}
+		set[e] = true
+	}
+
+	return set
+}
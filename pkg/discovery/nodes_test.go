@@ -0,0 +1,281 @@
+package discovery
+
+import (
+	"slices"
+	"testing"
+)
+
+// permutations returns every ordering of the given nodes.
+func permutations(nodes []Endpoint) [][]Endpoint {
+	if len(nodes) <= 1 {
+		return [][]Endpoint{nodes}
+	}
+
+	var all [][]Endpoint
+	for i := range nodes {
+		rest := append(slices.Clone(nodes[:i]), nodes[i+1:]...)
+		for _, p := range permutations(rest) {
+			all = append(all, append([]Endpoint{nodes[i]}, p...))
+		}
+	}
+	return all
+}
+
+func TestFormatOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		nodes   []Endpoint
+		want    string
+	}{
+		{
+			name: "by IP",
+			nodes: []Endpoint{
+				{IP: "10.0.0.10", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.9", PeerPort: 9107, APIPort: 9108, Pod: "ts-2"},
+				{IP: "10.0.0.9", PeerPort: 8107, APIPort: 8108, Pod: "ts-1"},
+				{IP: "10.0.1.1", PeerPort: 8107, APIPort: 8108},
+			},
+			want: "10.0.0.9:8107:8108,10.0.0.9:9107:9108,10.0.0.10:8107:8108,10.0.1.1:8107:8108",
+		},
+		{
+			name:    "by hostname",
+			options: Options{UseHostnames: true},
+			nodes: []Endpoint{
+				{IP: "10.0.0.3", Hostname: "ts-2", Namespace: "search", Service: "ts", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.1", Hostname: "ts-0", Namespace: "search", Service: "ts", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.2", PeerPort: 8107, APIPort: 8108},
+				{IP: "fd00::1", PeerPort: 8107, APIPort: 8108},
+			},
+			want: "10.0.0.2:8107:8108,[fd00::1]:8107:8108,ts-0.ts.search.svc.cluster.local:8107:8108,ts-2.ts.search.svc.cluster.local:8107:8108",
+		},
+		{
+			name:    "by pod",
+			options: Options{SortByPod: true},
+			nodes: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-10", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.2", Pod: "ts-9", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.3", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.0", Static: true, PeerPort: 8107, APIPort: 8108},
+			},
+			want: "10.0.0.3:8107:8108,10.0.0.2:8107:8108,10.0.0.1:8107:8108,10.0.0.0:8107:8108",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every ordering of the same nodes gives byte-identical contents.
+			for _, p := range permutations(tt.nodes) {
+				if got := tt.options.Format(p); got != tt.want {
+					t.Fatalf("Format(%v) = %q, want %q", p, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []Endpoint
+		want  []Endpoint
+	}{
+		{
+			name: "same pod in two subsets",
+			nodes: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.2", Pod: "ts-1", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.2", Pod: "ts-1", PeerPort: 8107, APIPort: 8108},
+			},
+		},
+		{
+			name: "first occurrence kept",
+			nodes: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 9107, APIPort: 9108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+			},
+		},
+		{
+			name: "different pods sharing a host",
+			nodes: []Endpoint{
+				{IP: "10.0.0.5", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.5", Pod: "ts-1", PeerPort: 9107, APIPort: 9108},
+				{IP: "10.0.0.5", Pod: "ts-2", PeerPort: 8107, APIPort: 8108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.5", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.5", Pod: "ts-1", PeerPort: 9107, APIPort: 9108},
+				{IP: "10.0.0.5", Pod: "ts-2", PeerPort: 8107, APIPort: 8108},
+			},
+		},
+		{
+			name: "static node on a discovered host",
+			nodes: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.1", Static: true, PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.9", Static: true, PeerPort: 8107, APIPort: 8108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.9", Static: true, PeerPort: 8107, APIPort: 8108},
+			},
+		},
+		{
+			name: "empty host",
+			nodes: []Endpoint{
+				{IP: "", Pod: "ts-0", PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.2", Pod: "ts-1", PeerPort: 8107, APIPort: 8108},
+				{IP: "", Static: true, PeerPort: 8107, APIPort: 8108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.2", Pod: "ts-1", PeerPort: 8107, APIPort: 8108},
+			},
+		},
+		{
+			name: "ready replaces not ready",
+			nodes: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", Service: "ts", NotReady: true, PeerPort: 8107, APIPort: 8108},
+				{IP: "10.0.0.1", Pod: "ts-0", Service: "ts-headless", PeerPort: 8107, APIPort: 8108},
+			},
+			want: []Endpoint{
+				{IP: "10.0.0.1", Pod: "ts-0", Service: "ts-headless", PeerPort: 8107, APIPort: 8108},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o Options
+			if got := o.Dedupe(tt.nodes); !slices.Equal(got, tt.want) {
+				t.Errorf("Dedupe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatEmptyHost(t *testing.T) {
+	nodes := []Endpoint{
+		{IP: "", Pod: "ts-0", Namespace: "search", Service: "ts", PeerPort: 8107, APIPort: 8108},
+		{IP: "10.0.0.2", Pod: "ts-1", Namespace: "search", Service: "ts", PeerPort: 8107, APIPort: 8108},
+	}
+
+	// A node without an IP is never written as a malformed entry like :8107:8108.
+	var o Options
+	if got, want := o.Format(nodes), "10.0.0.2:8107:8108"; got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+	if got := o.Format(nodes[:1]); got != "" {
+		t.Errorf("Format() of only a node without an IP = %q, want empty", got)
+	}
+	if got := o.Nodes(nodes); len(got) != 1 || got[0].Host != "10.0.0.2" {
+		t.Errorf("Nodes() = %v, want just 10.0.0.2", got)
+	}
+
+	// Unless it's listed by its hostname, which it still has.
+	nodes[0].Hostname = "ts-0"
+	o.UseHostnames = true
+	if got, want := o.Format(nodes[:1]), "ts-0.ts.search.svc.cluster.local:8107:8108"; got != want {
+		t.Errorf("Format() with hostnames = %q, want %q", got, want)
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    Endpoint
+		wantErr bool
+	}{
+		{entry: "10.0.0.1:8107:8108", want: Endpoint{IP: "10.0.0.1", Static: true, PeerPort: 8107, APIPort: 8108}},
+		{entry: "ts.example.com:8107:8108", want: Endpoint{IP: "ts.example.com", Static: true, PeerPort: 8107, APIPort: 8108}},
+		{entry: "[fd00::1]:8107:8108", want: Endpoint{IP: "fd00::1", Static: true, PeerPort: 8107, APIPort: 8108}},
+		{entry: ":8107:8108", wantErr: true},
+		{entry: "[]:8107:8108", wantErr: true},
+		{entry: "10.0.0.1", wantErr: true},
+		{entry: "10.0.0.1:8107", wantErr: true},
+		{entry: "10.0.0.1:0:8108", wantErr: true},
+		{entry: "10.0.0.1:8107:65536", wantErr: true},
+		{entry: "10.0.0.1:peer:8108", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNode(tt.entry)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseNode(%q) = %v, %v, want %v, error %v", tt.entry, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		nodes, want string
+	}{
+		{"", ""},
+		{"10.0.0.1:8107:8108", "10.0.0.1:8107:8108"},
+		{"10.0.0.2:8107:8108,10.0.0.1:8107:8108", "10.0.0.1:8107:8108,10.0.0.2:8107:8108"},
+		{"10.0.0.2:8107:8108,10.0.0.1:8107:8108\n", "10.0.0.1:8107:8108,10.0.0.2:8107:8108"},
+	}
+
+	for _, tt := range tests {
+		if got := Canonical(tt.nodes); got != tt.want {
+			t.Errorf("Canonical(%q) = %q, want %q", tt.nodes, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name                   string
+		previous, nodes        string
+		wantAdded, wantRemoved []string
+		wantUnchanged          int
+	}{
+		{
+			name:      "first write",
+			nodes:     "10.0.0.1:8107:8108,10.0.0.2:8107:8108",
+			wantAdded: []string{"10.0.0.1:8107:8108", "10.0.0.2:8107:8108"},
+		},
+		{
+			name:          "reordered",
+			previous:      "10.0.0.1:8107:8108,10.0.0.2:8107:8108",
+			nodes:         "10.0.0.2:8107:8108,10.0.0.1:8107:8108",
+			wantUnchanged: 2,
+		},
+		{
+			name:          "added and removed",
+			previous:      "10.0.0.1:8107:8108,10.0.0.2:8107:8108",
+			nodes:         "10.0.0.3:8107:8108,10.0.0.1:8107:8108",
+			wantAdded:     []string{"10.0.0.3:8107:8108"},
+			wantRemoved:   []string{"10.0.0.2:8107:8108"},
+			wantUnchanged: 1,
+		},
+		{
+			name:          "IPv6 written differently",
+			previous:      "[fd00:0:0::1]:8107:8108",
+			nodes:         "[fd00::1]:8107:8108",
+			wantUnchanged: 1,
+		},
+		{
+			name:        "ports changed",
+			previous:    "10.0.0.1:8107:8108",
+			nodes:       "10.0.0.1:9107:9108",
+			wantAdded:   []string{"10.0.0.1:9107:9108"},
+			wantRemoved: []string{"10.0.0.1:8107:8108"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed, unchanged := Diff(tt.previous, tt.nodes)
+			if !slices.Equal(added, tt.wantAdded) || !slices.Equal(removed, tt.wantRemoved) || unchanged != tt.wantUnchanged {
+				t.Errorf("Diff(%q, %q) = %v, %v, %d, want %v, %v, %d", tt.previous, tt.nodes, added, removed, unchanged, tt.wantAdded, tt.wantRemoved, tt.wantUnchanged)
+			}
+		})
+	}
+}
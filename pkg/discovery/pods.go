@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// FromPods returns the nodes for the given pods of the named service, by their pod IPs. Only pods
+// that are running, and whose named container has started, are listed. Whether they're ready
+// doesn't matter, so that pods waiting for quorum can still find their peers. If the container
+// name is empty, any running pod is listed. Pods that have been terminating for longer than
+// TerminatingGrace aren't listed.
+func (o *Options) FromPods(svc string, pods []*corev1.Pod, container string) []Endpoint {
+	nodes := make([]Endpoint, 0, len(pods))
+
+	for _, p := range pods {
+		if p.Status.Phase != corev1.PodRunning || Terminating(p, o.TerminatingGrace) || !started(p, container) {
+			continue
+		}
+
+		ip := o.podIP(p)
+		if ip == "" {
+			continue
+		}
+
+		named := make(map[string]int32)
+		for _, c := range p.Spec.Containers {
+			for _, port := range c.Ports {
+				if port.Name != "" {
+					named[port.Name] = port.ContainerPort
+				}
+			}
+		}
+
+		peer, api := o.portsFor(named)
+
+		// Kubernetes only publishes a DNS record for the pod's hostname under the service if the pod's
+		// subdomain is the service.
+		hostname := p.Spec.Hostname
+		if o.PublishedHostnamesOnly && p.Spec.Subdomain != svc {
+			hostname = ""
+		} else if hostname == "" && !o.PublishedHostnamesOnly {
+			hostname = p.Name
+		}
+
+		nodes = append(nodes, Endpoint{Namespace: p.Namespace, Service: svc, IP: ip, Hostname: hostname, Pod: p.Name, NodeName: p.Spec.NodeName, PeerPort: peer, APIPort: api})
+	}
+
+	return nodes
+}
+
+// Terminating reports whether the pod has been terminating for longer than the given grace period.
+func Terminating(p *corev1.Pod, grace time.Duration) bool {
+	if p.DeletionTimestamp == nil {
+		return false
+	}
+
+	// The deletion timestamp is when the pod will be killed, at the end of its own grace period.
+	since := p.DeletionTimestamp.Time
+	if p.DeletionGracePeriodSeconds != nil {
+		since = since.Add(-time.Duration(*p.DeletionGracePeriodSeconds) * time.Second)
+	}
+
+	return time.Since(since) >= grace
+}
+
+// started reports whether the pod's named container has started, or true if the name is empty.
+func started(p *corev1.Pod, container string) bool {
+	if container == "" {
+		return true
+	}
+
+	for _, s := range p.Status.ContainerStatuses {
+		if s.Name == container {
+			return s.Started != nil && *s.Started
+		}
+	}
+
+	return false
+}
+
+// podIP returns the pod's IP in the preferred IP family, or its primary IP if it has none in that
+// family.
+func (o *Options) podIP(p *corev1.Pod) string {
+	for _, a := range p.Status.PodIPs {
+		if ip := net.ParseIP(a.IP); ip != nil && (ip.To4() == nil) == (o.IPFamily == "ipv6") {
+			return a.IP
+		}
+	}
+
+	return p.Status.PodIP
+}
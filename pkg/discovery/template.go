@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Node is a node as given to a format template, or written by the JSON format.
+type Node struct {
+	// Host is the host the node is listed under, and IP and Hostname the pod IP and stable pod name
+	// it may be listed by.
+	Host     string `json:"host"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+
+	PeerPort int `json:"peer_port"`
+	APIPort  int `json:"api_port"`
+
+	// Entry is the node's entry in the Typesense nodes file format, host:peer:api, with an IPv6 host
+	// bracketed.
+	Entry string `json:"entry"`
+}
+
+// Presets are the named format templates.
+var Presets = map[string]string{
+	"typesense":  `{{range $i, $n := .}}{{if $i}},{{end}}{{$n.Entry}}{{end}}`,
+	"newline":    `{{range .}}{{.Entry}}{{"\n"}}{{end}}`,
+	"hosts-only": `{{range .}}{{.Host}}{{"\n"}}{{end}}`,
+}
+
+// ParseTemplate returns the format template given by the named preset, or by text if it isn't
+// empty.
+func ParseTemplate(preset, text string) (*template.Template, error) {
+	if text == "" {
+		var ok bool
+		if text, ok = Presets[preset]; !ok {
+			return nil, fmt.Errorf("unknown format %q", preset)
+		}
+	}
+
+	return template.New("nodes").Parse(text)
+}
+
+// Nodes returns the nodes at the given addresses, deduplicated and sorted in the same way as by
+// Format, for a format template. Nodes with the same entry are only listed once.
+func (o *Options) Nodes(addresses []Endpoint) []Node {
+	addresses = o.Sort(o.Dedupe(addresses))
+
+	nodes := make([]Node, 0, len(addresses))
+	for _, a := range addresses {
+		host := o.Host(a)
+
+		entry := FormatNode(host, a.PeerPort, a.APIPort)
+		if slices.ContainsFunc(nodes, func(n Node) bool { return n.Entry == entry }) {
+			continue
+		}
+
+		nodes = append(nodes, Node{
+			Host:     host,
+			IP:       a.IP,
+			Hostname: a.Hostname,
+			PeerPort: a.PeerPort,
+			APIPort:  a.APIPort,
+			Entry:    entry,
+		})
+	}
+
+	return nodes
+}
+
+// Render returns the output of the format template for the nodes at the given addresses.
+func (o *Options) Render(tmpl *template.Template, addresses []Endpoint) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, o.Nodes(addresses)); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nodesfile
+
+import "os"
+
+// lockFile does nothing outside Linux, where files written in place aren't locked.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing outside Linux.
+func unlockFile(f *os.File) error {
+	return nil
+}
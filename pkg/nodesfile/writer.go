@@ -0,0 +1,264 @@
+// Package nodesfile writes the Typesense nodes file, atomically, retrying failed writes.
+//
+// Like the rest of the module it's pre-v1, and a minor release may change it incompatibly.
+package nodesfile
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// rename is os.Rename, replaced in tests to fail as renames across mounts do.
+var rename = os.Rename
+
+// Writer writes a file atomically, retrying failed writes.
+type Writer struct {
+	// Path is the file to write.
+	Path string
+
+	// Mode is the mode to give the file, or zero to leave it as created, with 0666 less the umask.
+	Mode os.FileMode
+
+	// UID and GID are the owner to give the file, or -1 to leave them unchanged.
+	UID int
+	GID int
+
+	// Attempts is how many times to try each write before giving up, and RetryInterval how long to
+	// wait before the first retry. The wait doubles for each retry after that.
+	Attempts      int
+	RetryInterval time.Duration
+
+	// NoSync skips syncing the file and its directory to disk after each write, which is pointless
+	// on a tmpfs.
+	NoSync bool
+
+	// strategy is how the file was last written, so that a change of strategy is logged.
+	strategy string
+}
+
+// Write writes data to the file atomically, trying again when that fails until the number of
+// attempts is reached or ctx is done. It returns the last error if every attempt failed.
+func (w *Writer) Write(ctx context.Context, data []byte) error {
+	backoff := w.RetryInterval
+
+	for attempt := 1; ; attempt++ {
+		err := w.writeAtomic(data)
+		if err == nil || attempt >= w.Attempts {
+			return err
+		}
+
+		// Jitter spreads out the retries of sidecars that failed together, as on a node-level issue.
+		wait := backoff + rand.N(backoff/2+1)
+		slog.Warn("failed to write nodes file, retrying", "file", w.Path, "attempt", attempt, "retry_in", wait, "error", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+	}
+}
+
+// writeAtomic writes data to a temporary file next to the file and then renames it over the file,
+// so that readers only ever see the old or the new contents, never a partial write. If the file is a
+// symlink, as in a directory projected from a ConfigMap, the file it points to is written that way
+// instead, leaving the symlink in place. If the rename is impossible because the file is on a
+// different mount (or is itself a mount point, as with a subPath volume), the file is written in
+// place instead.
+func (w *Writer) writeAtomic(data []byte) error {
+	path, err := w.target()
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	// Remove any temporary file left behind by a previous failed write, otherwise it would keep
+	// whatever mode it was created with.
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := w.writeFile(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := w.setAttrs(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = rename(tmp, path)
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EBUSY) {
+		os.Remove(tmp)
+
+		if err := w.writeInPlace(path, data); err != nil {
+			return err
+		}
+		if err := w.setAttrs(path); err != nil {
+			return err
+		}
+
+		w.logStrategy("in place", path, err)
+		return nil
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The rename is only durable once the directory entry is on disk too.
+	if err := w.syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if path != w.Path {
+		w.logStrategy("rename in symlink target directory", path, nil)
+	} else {
+		w.logStrategy("rename", path, nil)
+	}
+	return nil
+}
+
+// target returns the file to write: the file at Path, or if that's a symlink, the file it resolves
+// to, so that the symlink isn't replaced by the rename. A symlink to a file that doesn't exist yet
+// resolves to where it points.
+func (w *Writer) target() (string, error) {
+	fi, err := os.Lstat(w.Path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return w.Path, nil
+	}
+
+	path, err := filepath.EvalSymlinks(w.Path)
+	if err == nil {
+		return path, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	link, err := os.Readlink(w.Path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(w.Path), link)
+	}
+
+	return link, nil
+}
+
+// logStrategy logs how the file was written, at info the first time and whenever that changes, since
+// writing in place isn't atomic, and otherwise at debug.
+func (w *Writer) logStrategy(strategy, path string, reason error) {
+	level := slog.LevelDebug
+	if strategy != w.strategy {
+		level = slog.LevelInfo
+	}
+	w.strategy = strategy
+
+	attrs := []any{"file", w.Path, "strategy", strategy}
+	if path != w.Path {
+		attrs = append(attrs, "target", path)
+	}
+	if reason != nil {
+		attrs = append(attrs, "reason", reason)
+	}
+
+	slog.Log(context.Background(), level, "wrote nodes file", attrs...)
+}
+
+// writeInPlace writes data over the file at path, for when it can't be replaced by a rename. The file
+// is locked while it's written, so that two writers don't interleave, and only truncated to the new
+// length once it's been written, so that a reader never finds it empty.
+func (w *Writer) writeInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+
+	if err := f.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+
+	if !w.NoSync {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+// writeFile writes data to the file at path, creating it if need be, and syncs it to disk before
+// closing it, so that a crash straight after can't leave it empty.
+func (w *Writer) writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if !w.NoSync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// syncDir syncs the directory at path to disk.
+func (w *Writer) syncDir(path string) error {
+	if w.NoSync {
+		return nil
+	}
+
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// setAttrs applies the configured mode and ownership to the file at path. Changing ownership
+// requires privileges the sidecar often doesn't have, so failing to do so only logs a warning.
+func (w *Writer) setAttrs(path string) error {
+	if w.Mode != 0 {
+		if err := os.Chmod(path, w.Mode); err != nil {
+			return err
+		}
+	}
+
+	if w.UID >= 0 || w.GID >= 0 {
+		if err := os.Chown(path, w.UID, w.GID); err != nil {
+			slog.Warn("failed to change ownership of nodes file", "file", path, "error", err)
+		}
+	}
+
+	return nil
+}
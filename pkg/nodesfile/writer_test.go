@@ -0,0 +1,306 @@
+package nodesfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newWriter returns a writer for a nodes file in a temporary directory.
+func newWriter(t *testing.T) *Writer {
+	t.Helper()
+	return &Writer{Path: filepath.Join(t.TempDir(), "nodes"), UID: -1, GID: -1, Attempts: 1}
+}
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWrite(t *testing.T) {
+	w := newWriter(t)
+	w.Mode = 0640
+
+	for _, contents := range []string{"10.0.0.1:8107:8108,10.0.0.2:8107:8108", "10.0.0.1:8107:8108"} {
+		if err := w.Write(context.Background(), []byte(contents)); err != nil {
+			t.Fatalf("Write(%q) = %v", contents, err)
+		}
+
+		if got := readFile(t, w.Path); got != contents {
+			t.Errorf("file = %q, want %q", got, contents)
+		}
+
+		fi, err := os.Stat(w.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("file mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+		}
+	}
+
+	// The temporary file is renamed away each time.
+	if _, err := os.Stat(filepath.Join(filepath.Dir(w.Path), ".nodes.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestWriteConcurrentReader(t *testing.T) {
+	w := newWriter(t)
+
+	// Each version of the file is a different length, so that a partial write, or one of a version
+	// written over a longer one, doesn't match either.
+	versions := []string{
+		strings.Repeat("10.0.0.1:8107:8108,", 500) + "end",
+		strings.Repeat("10.0.0.2:8107:8108,", 50) + "end",
+	}
+
+	if err := w.Write(context.Background(), []byte(versions[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := w.Write(context.Background(), []byte(versions[i%2])); err != nil {
+				t.Error(err)
+				break
+			}
+		}
+		close(done)
+	}()
+
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			wg.Wait()
+			if reads == 0 {
+				t.Error("file never read while it was being written")
+			}
+			return
+		default:
+		}
+
+		data, err := os.ReadFile(w.Path)
+		if err != nil {
+			t.Fatalf("reading file while it's written: %v", err)
+		}
+		if got := string(data); got != versions[0] && got != versions[1] {
+			t.Fatalf("read partial file of %d bytes", len(got))
+		}
+	}
+}
+
+func TestWriteRemovesStaleTemporaryFile(t *testing.T) {
+	w := newWriter(t)
+	dir := filepath.Dir(w.Path)
+
+	// A temporary file left behind by a failed write, with a mode other than the file's.
+	tmp := filepath.Join(dir, ".nodes.tmp")
+	if err := os.WriteFile(tmp, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Write(context.Background(), []byte("10.0.0.1:8107:8108")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, w.Path); got != "10.0.0.1:8107:8108" {
+		t.Errorf("file = %q, want 10.0.0.1:8107:8108", got)
+	}
+
+	// The file has the mode a newly created file gets, 0666 less the umask, not the stale file's.
+	ref := filepath.Join(dir, "ref")
+	if err := os.WriteFile(ref, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.Stat(w.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode().Perm() != want.Mode().Perm() {
+		t.Errorf("file mode = %v, want %v", got.Mode().Perm(), want.Mode().Perm())
+	}
+}
+
+func TestWriteSync(t *testing.T) {
+	// The temporary directory is usually on a disk, and /dev/shm a tmpfs, where syncing is pointless
+	// but must still work.
+	dirs := map[string]string{"temp dir": t.TempDir()}
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		dir, err := os.MkdirTemp("/dev/shm", "tsns-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		dirs["tmpfs"] = dir
+	}
+
+	for name, dir := range dirs {
+		for _, noSync := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/NoSync=%v", name, noSync), func(t *testing.T) {
+				w := &Writer{Path: filepath.Join(dir, fmt.Sprintf("nodes-%v", noSync)), UID: -1, GID: -1, Attempts: 1, NoSync: noSync}
+
+				if err := w.Write(context.Background(), []byte("10.0.0.1:8107:8108")); err != nil {
+					t.Fatal(err)
+				}
+				if got := readFile(t, w.Path); got != "10.0.0.1:8107:8108" {
+					t.Errorf("file = %q, want 10.0.0.1:8107:8108", got)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteSymlink(t *testing.T) {
+	// A directory projected from a ConfigMap, where the file is a symlink through ..data to a
+	// timestamped directory that's swapped out on each update.
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "..2024_01_01"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..2024_01_01", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..data/nodes", filepath.Join(dir, "nodes")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Writer{Path: filepath.Join(dir, "nodes"), UID: -1, GID: -1, Attempts: 1}
+
+	// The first write creates the file the symlink dangles at, and the second replaces it.
+	for _, contents := range []string{"10.0.0.1:8107:8108", "10.0.0.2:8107:8108"} {
+		if err := w.Write(context.Background(), []byte(contents)); err != nil {
+			t.Fatalf("Write(%q) = %v", contents, err)
+		}
+
+		fi, err := os.Lstat(w.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			t.Fatal("symlink replaced by the write")
+		}
+
+		if got := readFile(t, filepath.Join(dir, "..2024_01_01", "nodes")); got != contents {
+			t.Errorf("symlink target = %q, want %q", got, contents)
+		}
+		if got := readFile(t, w.Path); got != contents {
+			t.Errorf("file = %q, want %q", got, contents)
+		}
+	}
+
+	if w.strategy != "rename in symlink target directory" {
+		t.Errorf("strategy = %q, want rename in symlink target directory", w.strategy)
+	}
+}
+
+func TestWriteInPlaceFallback(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.EBUSY} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			// The rename fails as it does when the file is on another mount, or is a mount point.
+			old := rename
+			rename = func(from, to string) error { return &os.LinkError{Op: "rename", Old: from, New: to, Err: errno} }
+			t.Cleanup(func() { rename = old })
+
+			w := newWriter(t)
+			w.Mode = 0640
+
+			// A longer file is written over a shorter one, then a shorter one over that.
+			for _, contents := range []string{"10.0.0.1:8107:8108", "10.0.0.1:8107:8108,10.0.0.2:8107:8108", "10.0.0.3:8107:8108"} {
+				if err := w.Write(context.Background(), []byte(contents)); err != nil {
+					t.Fatalf("Write(%q) = %v", contents, err)
+				}
+				if got := readFile(t, w.Path); got != contents {
+					t.Errorf("file = %q, want %q", got, contents)
+				}
+			}
+
+			fi, err := os.Stat(w.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("file mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+			}
+
+			if _, err := os.Stat(filepath.Join(filepath.Dir(w.Path), ".nodes.tmp")); !os.IsNotExist(err) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+			if w.strategy != "in place" {
+				t.Errorf("strategy = %q, want in place", w.strategy)
+			}
+		})
+	}
+}
+
+func TestWriteInPlaceLocks(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("files written in place are only locked on Linux")
+	}
+
+	w := newWriter(t)
+	if err := os.WriteFile(w.Path, []byte("10.0.0.1:8107:8108"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer holds the lock.
+	f, err := os.Open(w.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.writeInPlace(w.Path, []byte("10.0.0.2:8107:8108")) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("writeInPlace() = %v while the file was locked, want it to wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if got := readFile(t, w.Path); got != "10.0.0.1:8107:8108" {
+		t.Errorf("file written while locked: %q", got)
+	}
+
+	if err := unlockFile(f); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeInPlace() didn't finish once the lock was released")
+	}
+
+	if got := readFile(t, w.Path); got != "10.0.0.2:8107:8108" {
+		t.Errorf("file = %q, want 10.0.0.2:8107:8108", got)
+	}
+}
@@ -0,0 +1,83 @@
+// Package sink defines where node lists are written to, so that programs discovering nodes with the
+// discovery package can send them wherever they need, alongside or instead of the nodes file.
+//
+// There's no registry of sinks. The tsns binary writes to the sinks its flags configure, and can't
+// be given others, so a program embedding this package holds its own Sinks and writes each node
+// list to every one of them itself, deciding how a failing sink affects the others.
+//
+// The Sink interface isn't settled until v1 of the module, and may gain methods before then.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+)
+
+// NodeList is a node list to be written to a sink.
+type NodeList struct {
+	// Nodes is the node list in the Typesense nodes file format.
+	Nodes string
+
+	// Endpoints is the endpoints the nodes are at, for sinks that write them in another format.
+	Endpoints []discovery.Endpoint
+}
+
+// Sink is somewhere node lists are written to.
+type Sink interface {
+	// Write writes the node list to the sink, returning an error if it couldn't be.
+	Write(ctx context.Context, nodes NodeList) error
+
+	// Name identifies the sink in logs and status, e.g. by the path of the file it writes.
+	Name() string
+}
+
+// File is a Sink that writes the node list to a file, atomically, with Writer.
+type File struct {
+	Writer nodesfile.Writer
+
+	// Render returns the contents of the file for the node list, or if nil, the file is written in
+	// the Typesense nodes file format.
+	Render func(nodes NodeList) (string, error)
+
+	// last is what was last written to the file.
+	last string
+}
+
+// Name returns the path of the file.
+func (f *File) Name() string {
+	return f.Writer.Path
+}
+
+// Write renders the node list and writes it to the file, unless the file still holds what was last
+// written to it and that's unchanged.
+func (f *File) Write(ctx context.Context, nodes NodeList) error {
+	contents := nodes.Nodes
+	if f.Render != nil {
+		var err error
+		if contents, err = f.Render(nodes); err != nil {
+			return fmt.Errorf("failed to render nodes file: %w", err)
+		}
+	}
+
+	if contents == f.last {
+		if b, err := os.ReadFile(f.Writer.Path); err == nil && string(b) == contents {
+			return nil
+		}
+	}
+
+	if err := f.Writer.Write(ctx, []byte(contents)); err != nil {
+		return err
+	}
+
+	f.last = contents
+	return nil
+}
+
+// Last returns what was last written to the file by Write, or nothing if it hasn't been written.
+func (f *File) Last() string {
+	return f.last
+}
@@ -0,0 +1,125 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+)
+
+// newFile returns a File sink for a nodes file in a temporary directory.
+func newFile(t *testing.T) *File {
+	t.Helper()
+	return &File{Writer: nodesfile.Writer{Path: filepath.Join(t.TempDir(), "nodes"), UID: -1, GID: -1, Attempts: 1, NoSync: true}}
+}
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileWrite(t *testing.T) {
+	f := newFile(t)
+	if f.Name() != f.Writer.Path {
+		t.Errorf("Name() = %q, want %q", f.Name(), f.Writer.Path)
+	}
+	if f.Last() != "" {
+		t.Errorf("Last() before any write = %q, want nothing", f.Last())
+	}
+
+	nodes := NodeList{Nodes: "10.0.0.1:8107:8108,10.0.0.2:8107:8108"}
+	if err := f.Write(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, f.Name()); got != nodes.Nodes {
+		t.Errorf("file = %q, want %q", got, nodes.Nodes)
+	}
+	if f.Last() != nodes.Nodes {
+		t.Errorf("Last() = %q, want %q", f.Last(), nodes.Nodes)
+	}
+}
+
+func TestFileWriteRender(t *testing.T) {
+	f := newFile(t)
+	f.Render = func(nodes NodeList) (string, error) {
+		var hosts []string
+		for _, e := range nodes.Endpoints {
+			hosts = append(hosts, e.IP)
+		}
+		return strings.Join(hosts, "\n"), nil
+	}
+
+	nodes := NodeList{
+		Nodes:     "10.0.0.1:8107:8108,10.0.0.2:8107:8108",
+		Endpoints: []discovery.Endpoint{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+	}
+	if err := f.Write(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, f.Name()), "10.0.0.1\n10.0.0.2"; got != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+	if got, want := f.Last(), "10.0.0.1\n10.0.0.2"; got != want {
+		t.Errorf("Last() = %q, want %q", got, want)
+	}
+
+	// A render that fails leaves the file and what was last written to it alone.
+	f.Render = func(NodeList) (string, error) { return "", errors.New("bad template") }
+	if err := f.Write(context.Background(), nodes); err == nil || !strings.Contains(err.Error(), "bad template") {
+		t.Errorf("Write() with a failing render = %v, want its error", err)
+	}
+	if got, want := readFile(t, f.Name()), "10.0.0.1\n10.0.0.2"; got != want {
+		t.Errorf("file after failed render = %q, want %q", got, want)
+	}
+	if got, want := f.Last(), "10.0.0.1\n10.0.0.2"; got != want {
+		t.Errorf("Last() after failed render = %q, want %q", got, want)
+	}
+}
+
+func TestFileWriteUnchanged(t *testing.T) {
+	f := newFile(t)
+	nodes := NodeList{Nodes: "10.0.0.1:8107:8108"}
+
+	if err := f.Write(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each write replaces the file, so the same file still being there means it wasn't written.
+	if err := f.Write(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("unchanged node list written again")
+	}
+
+	// A file changed by something else since is written again, even though the node list isn't.
+	if err := os.WriteFile(f.Name(), []byte("10.0.0.9:8107:8108"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, f.Name()); got != nodes.Nodes {
+		t.Errorf("file changed by something else = %q after write, want %q", got, nodes.Nodes)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podState is what's recorded in the -state-annotation on this sidecar's own pod each time the
+// nodes file is written, so that a restarted sidecar can pick up where it left off, and so that
+// operators can see what each sidecar last did.
+type podState struct {
+	// Hash identifies the node list written, as returned by nodesHash.
+	Hash string `json:"hash"`
+
+	// Count is the number of nodes in the node list written.
+	Count int `json:"count"`
+
+	// Written is when the node list was written.
+	Written time.Time `json:"written"`
+
+	// BootstrapSince is when bootstrapping started, if the node list written was predicted from
+	// the StatefulSet, and Predicted the number of nodes predicted.
+	BootstrapSince *time.Time `json:"bootstrapSince,omitempty"`
+	Predicted      int        `json:"predicted,omitempty"`
+}
+
+// nodesHash returns a short hash of the canonical form of the given node list. The node list itself
+// isn't recorded, as it's already in the nodes file, and could be too big for an annotation.
+func nodesHash(nodes string) string {
+	sum := sha256.Sum256([]byte(discovery.Canonical(nodes)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordPodState patches the -state-annotation on this sidecar's own pod with the given node list,
+// which has just been written. Failures are logged rather than returned, as the annotation is only
+// a convenience, and it's patched again on the next write.
+func recordPodState(ctx context.Context, clients kubernetes.Interface, nodes string) {
+	if stateAnnotation == "" || dryRun || podName == "" || podNamespace == "" {
+		return
+	}
+
+	state := podState{
+		Hash:    nodesHash(nodes),
+		Count:   discovery.Count(nodes),
+		Written: time.Now().UTC().Truncate(time.Second),
+	}
+	if bootstrapping.Load() {
+		since := bootstrapSince.UTC().Truncate(time.Second)
+		state.BootstrapSince, state.Predicted = &since, bootstrapSize
+	}
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		slog.Warn("failed to encode own pod state", "error", err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{stateAnnotation: string(value)},
+		},
+	})
+	if err != nil {
+		slog.Warn("failed to encode own pod state", "error", err)
+		return
+	}
+
+	if _, err := clients.CoreV1().Pods(podNamespace).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		slog.Warn("failed to record state on own pod", "pod", podName, "namespace", podNamespace, "annotation", stateAnnotation, "error", err)
+		return
+	}
+
+	slog.Debug("recorded state on own pod", "pod", podName, "namespace", podNamespace, "annotation", stateAnnotation, "state", string(value))
+}
+
+// restorePodState reads the -state-annotation back from this sidecar's own pod at startup, and if the
+// nodes file still holds the node list it records, seeds the state that would otherwise start cold
+// after a restart: when the nodes file was last written, and whether it was bootstrapping. It returns
+// when the nodes file was last written, or the zero time if that isn't known. Failures are logged
+// and otherwise ignored.
+func restorePodState(ctx context.Context, clients kubernetes.Interface) time.Time {
+	if stateAnnotation == "" || dryRun || podName == "" || podNamespace == "" || lastNodes == "" {
+		return time.Time{}
+	}
+
+	pod, err := clients.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		slog.Warn("failed to get own pod to restore its recorded state from", "pod", podName, "namespace", podNamespace, "error", err)
+		return time.Time{}
+	}
+
+	value, ok := pod.Annotations[stateAnnotation]
+	if !ok {
+		return time.Time{}
+	}
+
+	var state podState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		slog.Warn("ignoring invalid state recorded on own pod", "annotation", stateAnnotation, "value", value, "error", err)
+		return time.Time{}
+	}
+
+	// The nodes file was written by something else since, or the pod's volumes were replaced, so
+	// the state recorded no longer describes it.
+	if state.Hash != nodesHash(lastNodes) {
+		slog.Info("nodes file no longer holds the node list recorded on own pod, not restoring its state", "annotation", stateAnnotation, "recorded", state.Hash, "found", nodesHash(lastNodes))
+		return time.Time{}
+	}
+
+	lastWrite.set(state.Written)
+	nodesGauge.Set(float64(state.Count))
+
+	if bootstrapFromStatefulSet && state.BootstrapSince != nil {
+		bootstrapSince, bootstrapSize = *state.BootstrapSince, state.Predicted
+		setBootstrapping(true)
+	}
+
+	slog.Info("restored state recorded on own pod", "annotation", stateAnnotation, "node_count", state.Count, "written", state.Written, "bootstrapping", bootstrapping.Load())
+
+	return state.Written
+}
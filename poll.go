@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultPollInterval is how often endpoints are polled when watching them turns out to be
+// forbidden, if -poll-interval isn't set.
+const defaultPollInterval = 30 * time.Second
+
+// watchCheckTimeout is how long to wait to find out whether watching endpoints is allowed, so that
+// an unreachable remote cluster doesn't hold up startup.
+const watchCheckTimeout = 10 * time.Second
+
+// pollEvery returns how often endpoints are polled.
+func pollEvery() time.Duration {
+	if pollInterval > 0 {
+		return pollInterval
+	}
+	return defaultPollInterval
+}
+
+// watchForbidden reports whether watching the endpoints of the given service, or the pods matching
+// the given label selector in pods discovery mode, is forbidden, as where RBAC only grants get and
+// list. Any other error is left for the informer to retry.
+func watchForbidden(ctx context.Context, clients kubernetes.Interface, ns, svc, podLabels string) bool {
+	ctx, cancel := context.WithTimeout(ctx, watchCheckTimeout)
+	defer cancel()
+
+	var options metav1.ListOptions
+	selectEndpoints(svc, podLabels)(&options)
+
+	var w watch.Interface
+	var err error
+
+	switch {
+	case discoveryMode == "pods":
+		w, err = clients.CoreV1().Pods(ns).Watch(ctx, options)
+	case useEndpointSlices:
+		w, err = clients.DiscoveryV1().EndpointSlices(ns).Watch(ctx, options)
+	default:
+		w, err = clients.CoreV1().Endpoints(ns).Watch(ctx, options)
+	}
+	if err != nil {
+		return apierrors.IsForbidden(err)
+	}
+
+	w.Stop()
+	return false
+}
+
+// poll sends reasonPoll to events every interval, give or take a tenth of it so that many sidecars
+// started together don't poll together, until ctx is done.
+func poll(ctx context.Context, interval time.Duration, events chan<- string) {
+	for {
+		select {
+		case <-time.After(interval - interval/10 + rand.N(interval/5+1)):
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case events <- reasonPoll:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// preflight checks that the namespaces exist, that the services exist, and that tsns is allowed to
+// get, list and watch what it discovers nodes from in each namespace of the local cluster, so that a
+// misconfiguration fails fast rather than leaving the nodes file never written. A service that
+// doesn't exist yet only logs a warning, as it may be created later. Checks that can't be made, for
+// want of permission to make them or because the API server can't be reached, are skipped.
+func preflight(ctx context.Context, clients kubernetes.Interface) error {
+	var problems []string
+
+	for _, ns := range namespaces {
+		_, err := clients.CoreV1().Namespaces().Get(ctx, ns, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			problems = append(problems, fmt.Sprintf("namespace %s doesn't exist, check -namespace", ns))
+			continue
+		case err != nil:
+			slog.Debug("couldn't check namespace exists", "namespace", ns, "error", err)
+		}
+
+		for _, svc := range services {
+			_, err := clients.CoreV1().Services(ns).Get(ctx, svc, metav1.GetOptions{})
+			switch {
+			case apierrors.IsNotFound(err):
+				slog.Warn("service doesn't exist yet, no nodes will be found until it's created, check -service", "namespace", ns, "service", svc)
+			case err != nil:
+				slog.Debug("couldn't check service exists", "namespace", ns, "service", svc, "error", err)
+			}
+
+			denied, err := deniedVerbs(ctx, clients, ns, svc)
+			if err != nil {
+				slog.Debug("couldn't check permissions", "namespace", ns, "service", svc, "error", err)
+				continue
+			}
+
+			// Without watch, the endpoints are polled instead.
+			if len(denied) == 1 && denied[0] == "watch" {
+				slog.Info("not allowed to watch endpoints, they'll be polled", "namespace", ns, "service", svc)
+				continue
+			}
+
+			if len(denied) > 0 {
+				group, resource := discoveryResource()
+				problems = append(problems, fmt.Sprintf("not allowed to %s %s in namespace %s, grant the service account a Role with get, list and watch on %s in API group %q",
+					strings.Join(denied, ", "), resource, ns, resource, group))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("preflight checks failed (-skip-preflight to skip them): %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// deniedVerbs returns which of get, list and watch tsns isn't allowed on what it discovers the
+// nodes of the given service from, in the given namespace.
+func deniedVerbs(ctx context.Context, clients kubernetes.Interface, ns, svc string) ([]string, error) {
+	group, resource := discoveryResource()
+
+	var denied []string
+	for _, verb := range []string{"get", "list", "watch"} {
+		attrs := &authorizationv1.ResourceAttributes{Namespace: ns, Verb: verb, Group: group, Resource: resource}
+
+		// Endpoints are looked up by the service's name, so RBAC may be limited to it by name.
+		if resource == "endpoints" {
+			attrs.Name = svc
+		}
+
+		review, err := clients.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attrs},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		if !review.Status.Allowed {
+			denied = append(denied, verb)
+		}
+	}
+
+	return denied, nil
+}
+
+// discoveryResource returns the API group and resource that nodes are discovered from.
+func discoveryResource() (string, string) {
+	switch {
+	case discoveryMode == "pods":
+		return "", "pods"
+	case useEndpointSlices:
+		return "discovery.k8s.io", "endpointslices"
+	default:
+		return "", "endpoints"
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quorumCheckInterval is how often the nodes are checked again while waiting for quorum. It matches
+// how long health check results are cached for, so that every check probes the nodes afresh.
+const quorumCheckInterval = probeCacheTTL
+
+// waitForQuorum waits until a majority of the expected number of nodes pass their health check, as
+// with -wait-for-quorum, returning nil once they do, or an error if -wait-for-quorum-timeout passes
+// first. The nodes file isn't written. Progress is logged on every check.
+func waitForQuorum(ctx context.Context, clusters []cluster) error {
+	if waitForQuorumTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, waitForQuorumTimeout)
+		defer cancel()
+	}
+
+	expected, err := expectedClusterSize(ctx, clusters[0])
+	if err != nil {
+		return err
+	}
+
+	need := expected/2 + 1
+	slog.Info("waiting for quorum", "expected_nodes", expected, "need", need, "timeout", waitForQuorumTimeout)
+
+	var healthy int
+	for {
+		nodes, err := listQuorumNodes(ctx, clusters)
+		if err != nil {
+			slog.Warn("failed to list endpoints, retrying", "error", err)
+		} else {
+			healthy = 0
+			for _, err := range prober.probeAll(ctx, nodes) {
+				if err == nil {
+					healthy++
+				}
+			}
+
+			if healthy >= need {
+				slog.Info("quorum reached", "healthy", healthy, "node_count", len(nodes), "expected_nodes", expected, "need", need)
+				return nil
+			}
+
+			slog.Info("waiting for quorum", "healthy", healthy, "node_count", len(nodes), "expected_nodes", expected, "need", need)
+		}
+
+		select {
+		case <-time.After(quorumCheckInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for quorum, %d of %d expected nodes healthy, need %d", healthy, expected, need)
+		}
+	}
+}
+
+// expectedClusterSize returns the number of nodes the Typesense cluster is expected to have, as given
+// by -expected-nodes, or else the number of replicas of the StatefulSet given by
+// -bootstrap-statefulset or owning this sidecar's pod.
+func expectedClusterSize(ctx context.Context, local cluster) (int, error) {
+	if expectedNodes > 0 {
+		return expectedNodes, nil
+	}
+
+	if local.clients == nil {
+		return 0, fmt.Errorf("-wait-for-quorum needs -expected-nodes with -discovery-mode=dns")
+	}
+
+	var replicas int
+	err := retryStartup(ctx, "get statefulset", func(ctx context.Context) error {
+		name, err := bootstrapStatefulSetName(ctx, local.clients)
+		if err != nil {
+			return err
+		}
+
+		sts, err := local.clients.AppsV1().StatefulSets(bootstrapNamespace()).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		replicas = 1
+		if sts.Spec.Replicas != nil {
+			replicas = int(*sts.Spec.Replicas)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get statefulset to find the expected number of nodes from: %w", err)
+	}
+	if replicas == 0 {
+		return 0, fmt.Errorf("statefulset has no replicas, so quorum can't be reached")
+	}
+
+	return replicas, nil
+}
+
+// listQuorumNodes returns the nodes to check while waiting for quorum: those of the services in the
+// local cluster, and in whichever remote clusters can be reached, along with the static nodes.
+func listQuorumNodes(ctx context.Context, clusters []cluster) ([]discovery.Endpoint, error) {
+	nodes, err := listNodes(ctx, clusters[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range clusters[1:] {
+		found, err := listNodes(ctx, c)
+		if err != nil {
+			slog.Warn("failed to list endpoints in remote cluster", "cluster", c.name, "error", err)
+			continue
+		}
+		nodes = append(nodes, found...)
+	}
+
+	return withStaticNodes(nodeOptions.LimitNotReady(nodeOptions.Dedupe(nodes))), nil
+}
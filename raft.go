@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+// raftStates are the names of the raft states the local Typesense node reports by number.
+var raftStates = map[int]string{
+	1: "leader",
+	2: "transferring",
+	3: "candidate",
+	4: "follower",
+	5: "error",
+	6: "uninitialized",
+	7: "shutting_down",
+	8: "shutdown",
+}
+
+// raftView is the local Typesense node's view of its raft cluster, as last reported by its /debug
+// endpoint.
+type raftView struct {
+	// State is the node's raft state by name, and StateCode by number, or -1 if it isn't known.
+	State     string
+	StateCode int
+
+	// CommittedIndex is the index of the last raft log entry the node knows to be committed, if it
+	// reports it.
+	CommittedIndex int64
+
+	// At is when the view was last checked, and Err why it couldn't be, if it couldn't.
+	At  time.Time
+	Err error
+
+	// DisagreeingSince is when the node started being neither leader nor follower while the nodes
+	// file listed other nodes for it to be in a cluster with, if it is.
+	DisagreeingSince time.Time
+}
+
+// pollRaft checks the local Typesense node's raft state every -raft-poll-interval until ctx is done,
+// recording it for the status endpoint and metrics. It warns when the node has been neither leader
+// nor follower for longer than -raft-disagreement-after while the nodes file lists more than one
+// node, as then the nodes file isn't having the effect it should.
+func pollRaft(ctx context.Context) {
+	ticker := time.NewTicker(raftPollInterval)
+	defer ticker.Stop()
+
+	var since time.Time
+	var warned bool
+
+	for {
+		view := fetchRaft(ctx)
+
+		written := health.writtenNodes()
+		if view.Err == nil && view.State != "leader" && view.State != "follower" && discovery.Count(written) > 1 {
+			if since.IsZero() {
+				since = view.At
+			}
+
+			if !warned && time.Since(since) >= raftDisagreementAfter {
+				slog.Warn("local typesense node isn't in a cluster with the nodes listed", "state", view.State, "node_count", discovery.Count(written), "since", since)
+				warned = true
+			}
+		} else if !since.IsZero() {
+			if warned {
+				slog.Info("local typesense node is in a cluster again", "state", view.State, "since", since)
+			}
+			since, warned = time.Time{}, false
+		}
+
+		view.DisagreeingSince = since
+		health.setRaft(view)
+
+		raftStateGauge.Set(float64(view.StateCode))
+		if view.Err == nil {
+			raftCommittedIndexGauge.Set(float64(view.CommittedIndex))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchRaft returns the local Typesense node's raft state, as reported by its /debug endpoint. If
+// TYPESENSE_API_KEY is set it's sent as the API key.
+func fetchRaft(ctx context.Context) raftView {
+	view := raftView{StateCode: -1, At: time.Now()}
+
+	ctx, cancel := context.WithTimeout(ctx, verifyPeersTimeout)
+	defer cancel()
+
+	url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(apiPort)) + "/debug"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		view.Err = err
+		return view
+	}
+
+	if key := os.Getenv("TYPESENSE_API_KEY"); key != "" {
+		req.Header.Set("X-Typesense-Api-Key", key)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		view.Err = err
+		return view
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		view.Err = fmt.Errorf("unexpected status %d", res.StatusCode)
+		return view
+	}
+
+	// Versions of Typesense differ in whether they give the state by number or name.
+	var body struct {
+		State          json.RawMessage `json:"state"`
+		CommittedIndex int64           `json:"committed_index"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		view.Err = fmt.Errorf("failed to decode response: %w", err)
+		return view
+	}
+
+	view.CommittedIndex = body.CommittedIndex
+
+	var code int
+	var name string
+	switch {
+	case json.Unmarshal(body.State, &code) == nil:
+		view.StateCode, view.State = code, raftStates[code]
+	case json.Unmarshal(body.State, &name) == nil:
+		view.State = strings.ToLower(name)
+		for c, n := range raftStates {
+			if n == view.State {
+				view.StateCode = c
+			}
+		}
+	}
+
+	if view.State == "" {
+		view.State = "unknown"
+	}
+
+	return view
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/client-go/kubernetes"
+)
+
+// reconciler turns the nodes found by the sources into the node list, and writes it out if it's
+// changed, once for each call to reconcile. run sets it up with the sources and caches to build the
+// node list from, and it carries what later reconciles need to know from one to the next.
+type reconciler struct {
+	// clients are the clients for the local cluster, or nil in DNS discovery mode.
+	clients kubernetes.Interface
+
+	sources        []*source
+	lookupPod      podLookup
+	lookupService  serviceLookup
+	lookupKubeNode kubeNodeLookup
+	getStatefulSet statefulSetGetter
+
+	hooks *hookRunner
+
+	// events is where reconciles are asked for again, such as after a failed write, and fatal where an
+	// error that tsns can't carry on from is sent.
+	events chan string
+	fatal  chan error
+
+	// synced reports whether the local caches have synced, before which events are only counted.
+	synced func() bool
+
+	// recovering holds the checks for the API servers that couldn't be listed from coming back.
+	recovering recoveryChecks
+
+	// tooFewSince is when the number of nodes found first dropped below the minimum, if it has.
+	tooFewSince time.Time
+
+	// following is whether another replica was the leader, as of the last reconcile.
+	following bool
+
+	// retry is the timer that reconciles again after the nodes file couldn't be written, so that a
+	// failed write doesn't leave it stale until the endpoints next change.
+	retry *time.Timer
+
+	// lastWritten is when the nodes file was last written, and held the timer that reconciles again
+	// once -min-write-interval has passed since then, if a write was held back.
+	lastWritten time.Time
+	held        *time.Timer
+}
+
+// newReconciler returns a reconciler for the given sources, sending to the given channels.
+func newReconciler(clients kubernetes.Interface, sources []*source, events chan string, fatal chan error, hooks *hookRunner) *reconciler {
+	return &reconciler{
+		clients:    clients,
+		sources:    sources,
+		hooks:      hooks,
+		events:     events,
+		fatal:      fatal,
+		recovering: make(recoveryChecks),
+		following:  true,
+	}
+}
+
+// notify counts an event from one of the caches, and asks for a reconcile for the given reason once
+// the caches have synced. Until the initial list has been fully processed the store may only hold
+// some of the endpoints, and writing those would shrink the node list. The initial state is written
+// once the caches have synced instead.
+func (r *reconciler) notify(ctx context.Context, reason string) {
+	endpointEventsTotal.Inc()
+
+	if r.synced != nil && !r.synced() {
+		return
+	}
+
+	select {
+	case r.events <- reason:
+	case <-ctx.Done():
+	}
+}
+
+// reconcile builds the node list from the sources and writes it out, for the given reason and
+// number of events. The nodes file is left alone if the node list can't be built, or isn't to be
+// written yet.
+func (r *reconciler) reconcile(ctx context.Context, reason string, eventCount int) {
+	applyConfigChanges()
+	if reason == reasonOperator {
+		reloadStaticNodes()
+	}
+
+	var candidates []discovery.Endpoint
+	var unlisted []string
+	for _, src := range r.sources {
+		found, err := src.nodes()
+		if listsAll(reason) || src.polling {
+			// A periodic reconcile doesn't trust the cache, in case a watch event was missed, but
+			// falls back to it if the API can't be reached, checking for it to come back. A
+			// polled source is always listed, falling back to what it last listed.
+			listed, listErr := src.list(ctx)
+			if listErr != nil {
+				slog.Warn("failed to list endpoints, using cached endpoints", "cluster", src.cluster, "namespace", src.namespace, "service", src.service, "error", listErr)
+				unlisted = append(unlisted, sourceKey(src.cluster, src.namespace, src.service))
+				if src.clients != nil {
+					r.recovering.start(ctx, src.cluster, src.clients, r.events)
+				}
+			} else {
+				found, err = listed, nil
+				if src.polling {
+					src.polled = listed
+				}
+			}
+		}
+		if err != nil {
+			slog.Error("failed to list endpoints", "cluster", src.cluster, "namespace", src.namespace, "service", src.service, "error", err)
+			health.recordError(err)
+			return
+		}
+
+		slog.Debug("found nodes", "cluster", src.cluster, "namespace", src.namespace, "service", src.service, "node_count", len(found))
+		candidates = append(candidates, found...)
+	}
+
+	// Only a reconcile that lists the sources can tell whether they're still unreachable.
+	if listsAll(reason) || len(unlisted) > 0 {
+		if health.setDegraded(unlisted) {
+			slog.Info("all sources listed again, no longer degraded", "reason", reason)
+		}
+		degradedGauge.Set(float64(min(len(unlisted), 1)))
+	}
+
+	candidates, dropped, err := selectNodes(nodeOptions.Dedupe(candidates), r.lookupPod)
+	if err != nil {
+		slog.Error("failed to look up pods", "selector", podSelector, "error", err)
+		health.recordError(err)
+		return
+	}
+
+	candidates = nodeOptions.LimitNotReady(candidates)
+
+	terminatingNodesGauge.Set(float64(len(dropped.terminating)))
+
+	if candidates, err = sameZoneNodes(candidates, r.lookupKubeNode); err != nil {
+		slog.Error("failed to look up zones", "zone", localZone, "error", err)
+		health.recordError(err)
+		return
+	}
+
+	if candidates, dropped.nodeSelector, err = kubeNodeSelected(candidates, r.lookupKubeNode); err != nil {
+		slog.Error("failed to look up kubernetes nodes", "node_selector", kubeNodeSelector, "error", err)
+		health.recordError(err)
+		return
+	}
+
+	nodeSelectorDroppedGauge.Set(float64(len(dropped.nodeSelector)))
+
+	if len(candidates) > 0 {
+		nodesSeen.set(time.Now())
+	}
+
+	if candidates, err = externalNodes(candidates, r.lookupService); err != nil {
+		slog.Error("failed to look up per-pod services", "label", externalServiceLabel, "error", err)
+		health.recordError(err)
+		return
+	}
+
+	wasBootstrapping := bootstrapping.Load()
+	if candidates, err = bootstrapNodes(ctx, verifyPeerPorts(ctx, verifyNodes(ctx, verifySelf(ctx, candidates))), r.getStatefulSet); errors.Is(err, errBootstrapTimedOut) {
+		select {
+		case r.fatal <- err:
+		case <-ctx.Done():
+		}
+		return
+	} else if err != nil {
+		slog.Error("failed to get statefulset to bootstrap from", "error", err)
+		health.recordError(err)
+		return
+	}
+
+	// Reconcile again once the bootstrap timeout has passed, in case nothing else changes by then.
+	if !wasBootstrapping && bootstrapping.Load() && bootstrapTimeout > 0 {
+		time.AfterFunc(bootstrapTimeout, func() {
+			select {
+			case r.events <- reasonBootstrap:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	candidates = withStaticNodes(candidates)
+
+	var truncated int
+	if maxNodesAction == "truncate" {
+		candidates, truncated = capNodes(candidates)
+	}
+	maxNodesDroppedGauge.Set(float64(truncated))
+	reportSharedEntries(candidates)
+
+	n := nodeOptions.Format(candidates)
+	health.setNodes(n)
+
+	if leaderElect {
+		if !leading.Load() {
+			slog.Debug("not the leader, leaving the nodes file alone", "node_count", len(candidates))
+			r.following = true
+			return
+		}
+
+		// The previous leader may have written the nodes file since it was last read.
+		if r.following {
+			seedLastNodes()
+			r.following = false
+		}
+	}
+
+	if count := len(candidates); count < minNodes {
+		if r.tooFewSince.IsZero() {
+			r.tooFewSince = time.Now()
+		}
+
+		if minNodesOverrideAfter == 0 || time.Since(r.tooFewSince) < minNodesOverrideAfter {
+			slog.Warn("too few nodes found, keeping the previous nodes file", "node_count", count, "min_nodes", minNodes, "since", r.tooFewSince)
+			health.setTooFewNodes(count)
+			tooFewNodesGauge.Set(1)
+			return
+		}
+
+		slog.Warn("too few nodes found for too long, writing them anyway", "node_count", count, "min_nodes", minNodes, "since", r.tooFewSince)
+	} else {
+		r.tooFewSince = time.Time{}
+	}
+
+	health.setTooFewNodes(-1)
+	tooFewNodesGauge.Set(0)
+
+	if count := len(candidates); maxNodes > 0 && count > maxNodes {
+		slog.Warn("too many nodes found, keeping the previous nodes file", "node_count", count, "max_nodes", maxNodes)
+		health.setTooManyNodes(count)
+		return
+	}
+
+	health.setTooManyNodes(-1)
+
+	if truncated > 0 {
+		slog.Warn("too many nodes found, leaving some out", "node_count", len(candidates)+truncated, "max_nodes", maxNodes, "truncated", truncated)
+	}
+
+	if r.retry != nil {
+		r.retry.Stop()
+	}
+
+	// The nodes files may have been edited or removed by something else since they were written.
+	if (nodesFileChanged.Swap(false) || reason == reasonReconcile || reason == reasonOperator) && !dryRun {
+		checkNodesFiles()
+	}
+
+	if r.held != nil {
+		r.held.Stop()
+	}
+
+	if wait := minWriteInterval - time.Since(r.lastWritten); wait > 0 && reason != reasonOperator && !r.lastWritten.IsZero() && lastNodes != "" && bootstrapping.Load() == wasBootstrapping && discovery.Canonical(n) != lastNodes {
+		slog.Debug("holding back write until the minimum write interval has passed", "wait", wait, "node_count", len(candidates), "reason", reason)
+		writesSuppressedTotal.Inc()
+		r.held = time.AfterFunc(wait, func() {
+			select {
+			case r.events <- reasonHeld:
+			case <-ctx.Done():
+			}
+		})
+		return
+	}
+
+	previous := lastNodes
+	written, err := writeNodes(ctx, candidates, n, reason)
+	if err != nil {
+		slog.Error("failed to write nodes file", "files", nodesFiles, "retry_after", writeRetryAfter, "error", err)
+		recordWriteFailed(err)
+		r.retry = time.AfterFunc(writeRetryAfter, func() {
+			select {
+			case r.events <- reasonRetry:
+			case <-ctx.Done():
+			}
+		})
+
+		// Some of the files may have been written even though others failed.
+		if !written {
+			return
+		}
+	}
+
+	if written {
+		r.lastWritten = time.Now()
+		added, removed, unchanged := discovery.Diff(previous, n)
+		slog.Info("wrote nodes file", "files", nodesFiles, "node_count", discovery.Count(n), "added", added, "removed", removed, "unchanged", unchanged, "service_nodes", serviceCounts(candidates), "excluded_pods", dropped.excluded, "terminating_pods", dropped.terminating, "not_ready_pods", dropped.notReady, "node_selector_excluded", dropped.nodeSelector, "unreachable_peers", unreachablePeers, "reason", reason, "events", eventCount)
+		slog.Debug("wrote node list", "files", nodesFiles, "nodes", n)
+		recordNodesUpdated(previous, n)
+		r.hooks.queue(n, reason)
+		recordPodState(ctx, r.clients, n)
+		saveState(ctx, candidates)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// set sets *p to v for the rest of the test.
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// setupNodesFile sets the flags up as run does by default, for the ts service in the typesense
+// namespace, with the node list written to a nodes file in a temporary directory. It returns the
+// path of the nodes file.
+func setupNodesFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nodes")
+
+	set(t, &discoveryMode, "endpoints")
+	set(t, &namespaces, []string{"typesense"})
+	set(t, &services, []string{"ts"})
+	set(t, &nodeOptions, discovery.Options{PeerPort: 8107, APIPort: 8108, IPFamily: "ipv4"})
+	set(t, &nodesFiles, []string{path})
+	set(t, &nodesTargets, []*nodesTarget{newFileTarget(nodesfile.Writer{Path: path, UID: -1, GID: -1, Attempts: 1, NoSync: true}, false)})
+	set(t, &lastNodes, "")
+
+	return path
+}
+
+// startSource returns a source for the ts service in the typesense namespace, watched through the
+// given clients, once its cache has synced.
+func startSource(ctx context.Context, t *testing.T, clients kubernetes.Interface) *source {
+	t.Helper()
+	factory, src := newSource(cluster{clients: clients}, "typesense", "ts", "", false)
+	factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), src.informer.HasSynced) {
+		t.Fatal("source cache didn't sync")
+	}
+
+	return src
+}
+
+// newTestReconciler returns a reconciler for the given sources, with room on its events channel for
+// the reconciles it asks for.
+func newTestReconciler(ctx context.Context, sources ...*source) *reconciler {
+	return newReconciler(nil, sources, make(chan string, 10), make(chan error, 1), newHookRunner(ctx))
+}
+
+// waitFor waits for cond to hold, failing the test if it doesn't within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readNodesFile returns the contents of the nodes file at the given path, or "" if there isn't one.
+func readNodesFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// sourceNodes returns how many nodes the given source has in its cache.
+func sourceNodes(t *testing.T, src *source) int {
+	t.Helper()
+	nodes, err := src.nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(nodes)
+}
+
+// tsEndpoints returns the Endpoints of the ts service, with ready addresses at the given IPs.
+func tsEndpoints(ips ...string) *corev1.Endpoints {
+	e := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"},
+		Subsets: []corev1.EndpointSubset{{
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.9"}},
+		}},
+	}
+	for _, ip := range ips {
+		e.Subsets[0].Addresses = append(e.Subsets[0].Addresses, corev1.EndpointAddress{IP: ip})
+	}
+	return e
+}
+
+func TestReconcileEndpoints(t *testing.T) {
+	path := setupNodesFile(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := fake.NewSimpleClientset(tsEndpoints("10.0.0.2", "10.0.0.1"))
+	src := startSource(ctx, t, clients)
+	r := newTestReconciler(ctx, src)
+
+	r.reconcile(ctx, reasonStartup, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file after startup = %q, want %q", got, want)
+	}
+
+	_, err := clients.CoreV1().Endpoints("typesense").Update(ctx, tsEndpoints("10.0.0.2", "10.0.0.1", "10.0.0.3"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the update", func() bool { return sourceNodes(t, src) == 3 })
+
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108,10.0.0.3:8107:8108"; got != want {
+		t.Fatalf("nodes file after update = %q, want %q", got, want)
+	}
+
+	// With -min-nodes at zero, an empty node list is written like any other.
+	if err := clients.CoreV1().Endpoints("typesense").Delete(ctx, "ts", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delete", func() bool { return sourceNodes(t, src) == 0 })
+
+	r.reconcile(ctx, reasonEndpoints, 1)
+	if got, want := readNodesFile(t, path), ""; got != want {
+		t.Fatalf("nodes file after delete = %q, want %q", got, want)
+	}
+}
+
+func TestReconcileEndpointSlices(t *testing.T) {
+	path := setupNodesFile(t)
+	set(t, &useEndpointSlices, true)
+
+	ready, notReady := true, false
+	slice := func(name, svc string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "typesense",
+				Name:      name,
+				Labels:    map[string]string{discoveryv1.LabelServiceName: svc},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints:   endpoints,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := fake.NewSimpleClientset(
+		slice("ts-a", "ts",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.9"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+		),
+		slice("ts-b", "ts",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+		),
+		slice("other-a", "other",
+			discoveryv1.Endpoint{Addresses: []string{"10.0.1.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+		),
+	)
+	r := newTestReconciler(ctx, startSource(ctx, t, clients))
+
+	r.reconcile(ctx, reasonStartup, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file = %q, want %q", got, want)
+	}
+
+	// A periodic reconcile lists the slices from the API server rather than the cache.
+	r.reconcile(ctx, reasonReconcile, 0)
+	if got, want := readNodesFile(t, path), "10.0.0.1:8107:8108,10.0.0.2:8107:8108"; got != want {
+		t.Fatalf("nodes file after periodic reconcile = %q, want %q", got, want)
+	}
+}
+
+func TestReconcileMinNodes(t *testing.T) {
+	path := setupNodesFile(t)
+	set(t, &minNodes, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newTestReconciler(ctx, startSource(ctx, t, fake.NewSimpleClientset(tsEndpoints("10.0.0.1", "10.0.0.2"))))
+
+	r.reconcile(ctx, reasonStartup, 0)
+	if got := readNodesFile(t, path); got != "" {
+		t.Fatalf("nodes file with too few nodes = %q, want none", got)
+	}
+	if r.tooFewSince.IsZero() {
+		t.Error("tooFewSince not set with too few nodes")
+	}
+}
+
+func TestReconcileEmpty(t *testing.T) {
+	tests := []struct {
+		name          string
+		minNodes      int
+		overrideAfter time.Duration
+		want          string
+	}{
+		{name: "no minimum", want: ""},
+		{name: "too few", minNodes: 1, want: "10.0.0.1:8107:8108"},
+		{name: "too few for too long", minNodes: 1, overrideAfter: time.Nanosecond, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := setupNodesFile(t)
+			set(t, &minNodes, tt.minNodes)
+			set(t, &minNodesOverrideAfter, tt.overrideAfter)
+			if err := os.WriteFile(path, []byte("10.0.0.1:8107:8108"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			seedLastNodes()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			r := newTestReconciler(ctx, startSource(ctx, t, fake.NewSimpleClientset(tsEndpoints())))
+			r.reconcile(ctx, reasonStartup, 0)
+
+			if got := readNodesFile(t, path); got != tt.want {
+				t.Errorf("nodes file = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteNodesEmpty(t *testing.T) {
+	path := setupNodesFile(t)
+
+	// Nothing has been written yet, so an empty node list isn't taken to be up to date.
+	written, err := writeNodes(context.Background(), nil, "", reasonStartup)
+	if err != nil || !written {
+		t.Fatalf("writeNodes() of no nodes = %v, %v, want true, nil", written, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("nodes file not written: %v", err)
+	}
+
+	written, err = writeNodes(context.Background(), nil, "", reasonResync)
+	if err != nil || written {
+		t.Fatalf("writeNodes() of no nodes again = %v, %v, want false, nil", written, err)
+	}
+}
+
+func TestReconcileRetriesFailedWrite(t *testing.T) {
+	path := setupNodesFile(t)
+	set(t, &writeRetryAfter, 10*time.Millisecond)
+
+	// The nodes file can't be written into a directory that doesn't exist.
+	missing := filepath.Join(filepath.Dir(path), "missing", "nodes")
+	set(t, &nodesTargets, []*nodesTarget{newFileTarget(nodesfile.Writer{Path: missing, UID: -1, GID: -1, Attempts: 1, NoSync: true}, false)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newTestReconciler(ctx, startSource(ctx, t, fake.NewSimpleClientset(tsEndpoints("10.0.0.1"))))
+
+	r.reconcile(ctx, reasonStartup, 0)
+
+	select {
+	case reason := <-r.events:
+		if reason != reasonRetry {
+			t.Fatalf("reconcile asked for after failed write = %q, want %q", reason, reasonRetry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconcile asked for after failed write")
+	}
+
+	if lastNodes != "" {
+		t.Errorf("lastNodes after failed write = %q, want empty", lastNodes)
+	}
+}
+
+func TestWriteNodes(t *testing.T) {
+	path := setupNodesFile(t)
+
+	jsonPath := filepath.Join(filepath.Dir(path), "nodes.json")
+	set(t, &nodesTargets, append(nodesTargets, newFileTarget(nodesfile.Writer{Path: jsonPath, UID: -1, GID: -1, Attempts: 1, NoSync: true}, true)))
+
+	ctx := context.Background()
+	addresses := []discovery.Endpoint{{IP: "10.0.0.2", PeerPort: 8107, APIPort: 8108}, {IP: "10.0.0.1", PeerPort: 8107, APIPort: 8108}}
+	nodes := nodeOptions.Format(addresses)
+
+	written, err := writeNodes(ctx, addresses, nodes, reasonStartup)
+	if err != nil || !written {
+		t.Fatalf("writeNodes() = %v, %v, want true, nil", written, err)
+	}
+	if got := readNodesFile(t, path); got != nodes {
+		t.Errorf("nodes file = %q, want %q", got, nodes)
+	}
+	if got := readNodesFile(t, jsonPath); got == "" {
+		t.Error("JSON file not written")
+	}
+	if lastNodes != discovery.Canonical(nodes) {
+		t.Errorf("lastNodes = %q, want %q", lastNodes, discovery.Canonical(nodes))
+	}
+
+	// The same node list isn't written again, even listed in another order.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	written, err = writeNodes(ctx, addresses, "10.0.0.2:8107:8108,10.0.0.1:8107:8108", reasonResync)
+	if err != nil || written {
+		t.Fatalf("writeNodes() of unchanged nodes = %v, %v, want false, nil", written, err)
+	}
+	if got := readNodesFile(t, path); got != "" {
+		t.Errorf("nodes file rewritten with unchanged nodes: %q", got)
+	}
+}
+
+func TestReconcileBootstrapTimedOut(t *testing.T) {
+	tests := []struct {
+		name string
+		full bool
+	}{
+		{name: "fatal error sent"},
+		{name: "fatal error already pending", full: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupNodesFile(t)
+			set(t, &bootstrapFromStatefulSet, true)
+			set(t, &bootstrapTimeout, time.Nanosecond)
+			set(t, &bootstrapTimeoutAction, "exit")
+			set(t, &bootstrapTimedOut, false)
+			set(t, &bootstrapSince, time.Time{})
+			setBootstrapping(false)
+			t.Cleanup(func() { setBootstrapping(false) })
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The predicted node can't be reached, as health checks time out straight away.
+			r := newTestReconciler(ctx, startSource(ctx, t, fake.NewSimpleClientset(tsEndpoints())))
+			r.getStatefulSet = func() (*appsv1.StatefulSet, error) {
+				return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"}, Spec: appsv1.StatefulSetSpec{ServiceName: "ts"}}, nil
+			}
+
+			// Exiting once no nodes have been discovered for too long got there first.
+			pending := errors.New("no nodes discovered")
+			if tt.full {
+				r.fatal <- pending
+				cancel()
+			}
+
+			done := make(chan struct{})
+			go func() {
+				r.reconcile(ctx, reasonStartup, 0)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("reconcile blocked sending the fatal error")
+			}
+
+			want := errBootstrapTimedOut
+			if tt.full {
+				want = pending
+			}
+			if err := <-r.fatal; err != want {
+				t.Errorf("fatal error = %v, want %v", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strconv"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podSelector is the parsed -selector flag, or nil if nodes aren't filtered by their pods' labels.
+var podSelector labels.Selector
+
+// podLookup returns the pod behind a node, or nil if it doesn't match the pod selector.
+type podLookup func(n discovery.Endpoint) (*corev1.Pod, error)
+
+// usePods reports whether nodes depend on their pods, through the pod selector, the exclude
+// annotation, the port annotations, excluding terminating pods, requiring the Typesense container
+// to be ready or taking hostnames from pods.
+func usePods() bool {
+	return podSelector != nil || excludeAnnotation != "" || peerPortAnnotation != "" || apiPortAnnotation != "" || excludeTerminating || requireContainerReady || hostnamesFromPods
+}
+
+// droppedPods names the pods whose nodes were dropped by selectNodes and kubeNodeSelected, by why
+// they were dropped.
+type droppedPods struct {
+	excluded    []string
+	terminating []string
+	notReady    []string
+
+	// nodeSelector also names nodes without pods, by their IPs.
+	nodeSelector []string
+}
+
+// newPodCache returns an informer caching the pods in the given namespace of the given cluster that
+// match the pod selector, the informer factory that must be started for it to run, and a podLookup
+// that looks pods up in its cache. Only matching pods are listed and watched, so a pod that stops
+// matching is seen as deleted.
+func newPodCache(c cluster, ns string) (informers.SharedInformerFactory, cache.SharedIndexInformer, podLookup) {
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clients, resyncInterval,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(selectPods),
+	)
+
+	pods := factory.Core().V1().Pods()
+	lister := pods.Lister().Pods(ns)
+
+	return factory, pods.Informer(), func(n discovery.Endpoint) (*corev1.Pod, error) {
+		pod, err := lister.Get(n.Pod)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return pod, err
+	}
+}
+
+// listPodLookup returns a podLookup for the pods that match the pod selector in each namespace of
+// the given clusters, as listed from their API servers, without going through an informer. Failing
+// to list the pods in a remote cluster only logs a warning, leaving its nodes unmatched.
+func listPodLookup(ctx context.Context, clusters []cluster) (podLookup, error) {
+	options := metav1.ListOptions{}
+	selectPods(&options)
+
+	matching := make(map[string]*corev1.Pod)
+	for _, c := range clusters {
+		for _, ns := range namespaces {
+			list, err := c.clients.CoreV1().Pods(ns).List(ctx, options)
+			if err != nil {
+				if c.name == "" {
+					return nil, err
+				}
+
+				slog.Warn("failed to list pods in remote cluster", "cluster", c.name, "namespace", ns, "error", err)
+				continue
+			}
+
+			for i := range list.Items {
+				p := &list.Items[i]
+				matching[path.Join(c.name, ns, p.Name)] = p
+			}
+		}
+	}
+
+	return func(n discovery.Endpoint) (*corev1.Pod, error) {
+		return matching[path.Join(n.Cluster, n.Namespace, n.Pod)], nil
+	}, nil
+}
+
+// selectPods restricts list and watch requests to the pods matching the pod selector, if there is
+// one.
+func selectPods(options *metav1.ListOptions) {
+	if podSelector != nil {
+		options.LabelSelector = podSelector.String()
+	}
+}
+
+// excluded reports whether the pod has the exclude annotation set to true.
+func excluded(pod *corev1.Pod) bool {
+	return excludeAnnotation != "" && pod.Annotations[excludeAnnotation] == "true"
+}
+
+// podChanged reports whether a pod update changes what its node is listed as.
+func podChanged(old, new *corev1.Pod) bool {
+	if (old.DeletionTimestamp == nil) != (new.DeletionTimestamp == nil) {
+		return true
+	}
+
+	if requireContainerReady && containerReady(old, typesenseContainer) != containerReady(new, typesenseContainer) {
+		return true
+	}
+
+	for _, key := range []string{excludeAnnotation, peerPortAnnotation, apiPortAnnotation} {
+		if key != "" && old.Annotations[key] != new.Annotations[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podHostname returns the node with the hostname and subdomain given by its pod, with
+// -hostnames-from-pods, so that it's listed by the DNS name Kubernetes publishes for the pod. Without
+// both, or without a pod, it has no hostname and is listed by its IP.
+func podHostname(n discovery.Endpoint, pod *corev1.Pod) discovery.Endpoint {
+	if !hostnamesFromPods {
+		return n
+	}
+
+	n.Hostname, n.Subdomain = "", ""
+
+	switch {
+	case pod == nil:
+		slog.Warn("listing node by its IP, as its pod isn't known", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod)
+	case pod.Spec.Hostname != "" && pod.Spec.Subdomain != "":
+		n.Hostname, n.Subdomain = pod.Spec.Hostname, pod.Spec.Subdomain
+	}
+
+	return n
+}
+
+// containerReady reports whether the pod's named container is ready, and isn't waiting to be
+// restarted after crashing.
+func containerReady(p *corev1.Pod, container string) bool {
+	for _, s := range p.Status.ContainerStatuses {
+		if s.Name == container {
+			return s.Ready && (s.State.Waiting == nil || s.State.Waiting.Reason != "CrashLoopBackOff")
+		}
+	}
+
+	return false
+}
+
+// podPorts returns the node with its ports replaced by those given by the port annotations on its
+// pod, where set. An invalid port is logged and the node's own port kept.
+func podPorts(n discovery.Endpoint, pod *corev1.Pod) discovery.Endpoint {
+	for _, a := range []struct {
+		key  string
+		port *int
+	}{
+		{peerPortAnnotation, &n.PeerPort},
+		{apiPortAnnotation, &n.APIPort},
+	} {
+		value, ok := pod.Annotations[a.key]
+		if a.key == "" || !ok {
+			continue
+		}
+
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || port == 0 {
+			slog.Warn("ignoring invalid port annotation", "namespace", n.Namespace, "pod", n.Pod, "annotation", a.key, "value", value)
+			continue
+		}
+
+		*a.port = int(port)
+	}
+
+	return n
+}
+
+// selectNodes returns the nodes whose pods match the pod selector, if there is one, aren't excluded
+// by the exclude annotation and, with -exclude-terminating, haven't been terminating for longer
+// than the terminating grace period and, with -require-container-ready, whose Typesense container
+// is ready, with their ports overridden by the port annotations and, with -hostnames-from-pods,
+// their hostnames taken from their pods. It also returns the names of the pods that were dropped.
+// Nodes whose endpoints don't refer to a pod, or whose pods aren't known, are kept only if there's
+// no pod selector or -selector-include-unknown is set.
+func selectNodes(nodes []discovery.Endpoint, lookup podLookup) ([]discovery.Endpoint, droppedPods, error) {
+	var dropped droppedPods
+	if !usePods() {
+		return nodes, dropped, nil
+	}
+
+	selected := make([]discovery.Endpoint, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Pod == "" {
+			if podSelector == nil || selectorIncludeUnknown {
+				selected = append(selected, podHostname(n, nil))
+			} else {
+				slog.Debug("dropping node without a pod", "ip", n.IP, "namespace", n.Namespace, "service", n.Service)
+			}
+			continue
+		}
+
+		pod, err := lookup(n)
+		if err != nil {
+			return nil, dropped, err
+		}
+
+		switch {
+		case pod == nil && podSelector != nil:
+			slog.Debug("dropping node whose pod doesn't match the selector", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod)
+		case pod != nil && excluded(pod):
+			slog.Debug("dropping node whose pod is excluded", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "annotation", excludeAnnotation)
+			dropped.excluded = append(dropped.excluded, path.Join(n.Cluster, n.Namespace, n.Pod))
+		case pod != nil && excludeTerminating && discovery.Terminating(pod, terminatingGrace):
+			slog.Debug("dropping node whose pod is terminating", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "deletion_timestamp", pod.DeletionTimestamp)
+			dropped.terminating = append(dropped.terminating, path.Join(n.Cluster, n.Namespace, n.Pod))
+		case pod != nil && requireContainerReady && !containerReady(pod, typesenseContainer):
+			slog.Debug("dropping node whose typesense container isn't ready", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "container", typesenseContainer)
+			dropped.notReady = append(dropped.notReady, path.Join(n.Cluster, n.Namespace, n.Pod))
+		case pod != nil:
+			selected = append(selected, podHostname(podPorts(n, pod), pod))
+		default:
+			selected = append(selected, podHostname(n, nil))
+		}
+	}
+
+	return selected, dropped, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// captureLogs returns a buffer that the default logger writes to for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestReconcileHostNetworkPods(t *testing.T) {
+	// Two hostNetwork pods on the same Kubernetes node have the same IP.
+	shared := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: "ts"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.5", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "ts-0"}},
+				{IP: "10.0.0.5", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "ts-1"}},
+			},
+		}},
+	}
+	pod := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "typesense", Name: name, Annotations: annotations},
+			Spec:       corev1.PodSpec{HostNetwork: true},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		ts1       map[string]string
+		want      string
+		wantError bool
+	}{
+		{
+			name: "told apart by port annotations",
+			ts1:  map[string]string{"tsns.tigrisdata.dev/peer-port": "9107", "tsns.tigrisdata.dev/api-port": "9108"},
+			want: "10.0.0.5:8107:8108,10.0.0.5:9107:9108",
+		},
+		{
+			name:      "same ports",
+			want:      "10.0.0.5:8107:8108",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := setupNodesFile(t)
+			set(t, &peerPortAnnotation, "tsns.tigrisdata.dev/peer-port")
+			set(t, &apiPortAnnotation, "tsns.tigrisdata.dev/api-port")
+			logs := captureLogs(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clients := fake.NewSimpleClientset(shared, pod("ts-0", nil), pod("ts-1", tt.ts1))
+			factory, informer, lookup := newPodCache(cluster{clients: clients}, "typesense")
+			factory.Start(ctx.Done())
+			if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+				t.Fatal("pod cache didn't sync")
+			}
+
+			r := newTestReconciler(ctx, startSource(ctx, t, clients))
+			r.lookupPod = lookup
+			r.reconcile(ctx, reasonStartup, 0)
+
+			if got := readNodesFile(t, path); got != tt.want {
+				t.Errorf("nodes file = %q, want %q", got, tt.want)
+			}
+
+			var reported bool
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, "pods share a host and ports") {
+					reported = true
+					if !strings.Contains(line, "typesense/ts-0") || !strings.Contains(line, "typesense/ts-1") {
+						t.Errorf("error doesn't name both pods: %s", line)
+					}
+				}
+			}
+			if reported != tt.wantError {
+				t.Errorf("reported pods sharing an entry = %v, want %v", reported, tt.wantError)
+			}
+		})
+	}
+}
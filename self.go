@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// serviceAccountNamespaceFile holds the namespace of the service account a pod runs as, which is the
+// pod's own namespace.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// podNameFromHostname is whether -pod-name was taken from the hostname, so is only a guess until
+// checkOwnPod has confirmed it.
+var podNameFromHostname bool
+
+// resolveOwnPod fills in -pod-name and -pod-namespace, naming this sidecar's own pod, where they
+// aren't set. The name comes from $POD_NAME, or else, when running in a pod, the hostname, which is
+// the pod's name unless the pod sets a hostname of its own or uses the host's network. Outside a pod
+// the hostname is the machine's, so the name is left empty. The namespace comes from $POD_NAMESPACE,
+// or else the service account's namespace. Where each came from is logged.
+func resolveOwnPod() {
+	nameSource, namespaceSource := "flag", "flag"
+
+	if podName == "" {
+		podName, nameSource = os.Getenv("POD_NAME"), "$POD_NAME"
+	}
+	if podName == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		podName, _ = os.Hostname()
+		nameSource, podNameFromHostname = "hostname", podName != ""
+	}
+	if podName == "" {
+		nameSource = "unknown"
+	}
+
+	if podNamespace == "" {
+		podNamespace, namespaceSource = os.Getenv("POD_NAMESPACE"), "$POD_NAMESPACE"
+	}
+	if podNamespace == "" {
+		if b, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+			podNamespace, namespaceSource = strings.TrimSpace(string(b)), "service account"
+		}
+	}
+	if podNamespace == "" {
+		namespaceSource = "unknown"
+	}
+
+	slog.Info("identified own pod", "pod", podName, "namespace", podNamespace, "pod_source", nameSource, "namespace_source", namespaceSource)
+}
+
+// checkOwnPod checks that the pod named by the hostname exists, if that's where -pod-name came from,
+// and isn't a hostNetwork pod, whose hostname is its Kubernetes node's. If it doesn't, the name is
+// cleared, so that nothing acts on a pod that isn't this sidecar's. If the pod can't be got, as when
+// tsns isn't allowed to get pods, the name is kept, with a warning.
+func checkOwnPod(ctx context.Context, clients kubernetes.Interface) {
+	if !podNameFromHostname || clients == nil {
+		return
+	}
+
+	pod, err := clients.CoreV1().Pods(bootstrapNamespace()).Get(ctx, podName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		slog.Warn("no pod is named after the hostname, as when using the host's network, so own pod is unknown. Set -pod-name from the downward API", "hostname", podName, "namespace", bootstrapNamespace())
+		podName, podNameFromHostname = "", false
+	case err != nil:
+		slog.Warn("failed to get the pod named after the hostname, assuming it's this pod. Set -pod-name from the downward API to be sure", "pod", podName, "namespace", bootstrapNamespace(), "error", err)
+	case pod.Spec.HostNetwork:
+		slog.Warn("pod named after the hostname uses the host's network, so its hostname may be its Kubernetes node's. Set -pod-name from the downward API to be sure", "pod", podName, "namespace", bootstrapNamespace())
+	default:
+		podNameFromHostname = false
+	}
+}
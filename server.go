@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servers holds the HTTP handlers to serve, keyed by the address to serve them on. Endpoints
+// configured with the same address share a listener.
+var servers = make(map[string]*http.ServeMux)
+
+// serverMux returns the mux for the server listening on addr, creating it if necessary.
+func serverMux(addr string) *http.ServeMux {
+	mux, ok := servers[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		servers[addr] = mux
+	}
+
+	return mux
+}
+
+// handlePprof registers the net/http/pprof handlers on mux, under /debug/pprof/, as they'd be
+// registered on the default mux.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// serveHTTP starts each configured server, stopping them once ctx is done. If a server fails, its
+// error is sent on the returned channel.
+func serveHTTP(ctx context.Context) <-chan error {
+	errs := make(chan error, len(servers))
+
+	for addr, mux := range servers {
+		go func(addr string, mux *http.ServeMux) {
+			if err := serve(ctx, addr, mux); err != nil {
+				errs <- err
+			}
+		}(addr, mux)
+	}
+
+	return errs
+}
+
+// serve serves handler on addr until ctx is done.
+func serve(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve on %s: %w", addr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signals are the signals -signal can name.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// parseSignal returns the signal with the given name, with or without the SIG prefix, in any case.
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q, must be HUP, INT, QUIT, TERM, USR1 or USR2", name)
+	}
+
+	return sig, nil
+}
+
+// findProcesses returns the PIDs of the processes whose command is the given name, other than
+// this one, by looking through /proc. It only sees the processes of other containers in the pod
+// if the pod shares its process namespace.
+func findProcesses(name string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		// The command line is used rather than comm, as comm is cut short at 15 characters, which
+		// would leave typesense-server as typesense-serve. Processes may exit as we go, so failing to
+		// read one just skips it.
+		cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+
+		command, _, _ := bytes.Cut(cmdline, []byte{0})
+		if filepath.Base(string(command)) == name {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errSignalUnsupported is returned when signalling the Typesense process outside Linux.
+var errSignalUnsupported = errors.New("signalling the typesense process is only supported on linux")
+
+// parseSignal isn't supported outside Linux.
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errSignalUnsupported
+}
+
+// findProcesses isn't supported outside Linux.
+func findProcesses(name string) ([]int, error) {
+	return nil, errSignalUnsupported
+}
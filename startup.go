@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// startupBackoff is how long to wait before retrying a failed startup step the first time. The
+	// wait doubles for each retry after that, up to startupBackoffMax.
+	startupBackoff    = 500 * time.Millisecond
+	startupBackoffMax = 30 * time.Second
+)
+
+// startupDeadline is when to give up on starting up, or zero to keep trying for as long as it takes.
+var startupDeadline time.Time
+
+// withStartupDeadline returns a copy of ctx that's done once the startup deadline passes, if there
+// is one.
+func withStartupDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if startupDeadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, startupDeadline)
+}
+
+// retryStartup calls f until it succeeds, backing off between attempts, so that an API server that
+// is briefly unreachable as the pod starts doesn't fail it. It gives up, returning the last error,
+// once the startup deadline passes or ctx is done.
+func retryStartup(ctx context.Context, step string, f func(ctx context.Context) error) error {
+	ctx, cancel := withStartupDeadline(ctx)
+	defer cancel()
+
+	backoff := startupBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("startup step failed, retrying", "step", step, "attempt", attempt, "retry_in", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		backoff = min(backoff*2, startupBackoffMax)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"github.com/seeruk/tsns/pkg/nodesfile"
+)
+
+// stateFileVersion is the version of the state file's format. A state file of any other version is
+// ignored, so the format must be given a new version whenever it changes.
+const stateFileVersion = 1
+
+// stateWriter writes the -state-file, or is nil if there isn't one.
+var stateWriter *nodesfile.Writer
+
+// savedNodes holds the nodes loaded from the state file at startup, by cluster, namespace and
+// service, for seeding the sources that have nothing to go on until they're first listed.
+var savedNodes map[string][]discovery.Endpoint
+
+// stateDocument is what's written to the state file: the nodes last written to the nodes file, with
+// what's needed to write it again without being able to reach the API server.
+type stateDocument struct {
+	Version int         `json:"version"`
+	SavedAt time.Time   `json:"saved_at"`
+	Nodes   []stateNode `json:"nodes"`
+}
+
+// stateNode is one of the nodes in the state file. Static nodes aren't saved, as they're always
+// given by -extra-nodes.
+type stateNode struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	IP        string `json:"ip"`
+	Hostname  string `json:"hostname,omitempty"`
+	Subdomain string `json:"subdomain,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	NodeName  string `json:"node_name,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	NotReady  bool   `json:"not_ready,omitempty"`
+	PeerPort  int    `json:"peer_port"`
+	APIPort   int    `json:"api_port"`
+}
+
+// saveState writes the given nodes, which have just been written to the nodes file, to the state
+// file. Failures are logged rather than returned, so they never get in the way of the nodes file, and
+// the state file is written again on the next write.
+func saveState(ctx context.Context, nodes []discovery.Endpoint) {
+	if stateWriter == nil || dryRun {
+		return
+	}
+
+	doc := stateDocument{Version: stateFileVersion, SavedAt: time.Now().UTC().Truncate(time.Second), Nodes: []stateNode{}}
+	for _, n := range nodes {
+		if n.Static {
+			continue
+		}
+
+		doc.Nodes = append(doc.Nodes, stateNode{
+			Cluster:   n.Cluster,
+			Namespace: n.Namespace,
+			Service:   n.Service,
+			IP:        n.IP,
+			Hostname:  n.Hostname,
+			Subdomain: n.Subdomain,
+			Pod:       n.Pod,
+			NodeName:  n.NodeName,
+			Zone:      n.Zone,
+			NotReady:  n.NotReady,
+			PeerPort:  n.PeerPort,
+			APIPort:   n.APIPort,
+		})
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err == nil {
+		err = stateWriter.Write(ctx, append(b, '\n'))
+	}
+	if err != nil {
+		slog.Warn("failed to write state file", "file", stateWriter.Path, "error", err)
+	}
+}
+
+// loadState reads the nodes saved in the state file, returning an error if it isn't a valid state
+// file of the current version. A state file that doesn't exist holds no nodes.
+func loadState() ([]discovery.Endpoint, error) {
+	b, err := os.ReadFile(stateWriter.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var doc stateDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+
+	if doc.Version != stateFileVersion {
+		return nil, fmt.Errorf("state file is version %d, not %d", doc.Version, stateFileVersion)
+	}
+
+	nodes := make([]discovery.Endpoint, 0, len(doc.Nodes))
+	for i, n := range doc.Nodes {
+		switch {
+		case n.IP == "" || n.Namespace == "" || n.Service == "":
+			return nil, fmt.Errorf("state file node %d has no address, namespace or service", i)
+		case !validPort(n.PeerPort) || !validPort(n.APIPort):
+			return nil, fmt.Errorf("state file node %d has invalid ports %d and %d", i, n.PeerPort, n.APIPort)
+		}
+
+		nodes = append(nodes, discovery.Endpoint{
+			Cluster:   n.Cluster,
+			Namespace: n.Namespace,
+			Service:   n.Service,
+			IP:        n.IP,
+			Hostname:  n.Hostname,
+			Subdomain: n.Subdomain,
+			Pod:       n.Pod,
+			NodeName:  n.NodeName,
+			Zone:      n.Zone,
+			NotReady:  n.NotReady,
+			PeerPort:  n.PeerPort,
+			APIPort:   n.APIPort,
+		})
+	}
+
+	return nodes, nil
+}
+
+// restoreState loads the state file at startup, keeping its nodes to seed the sources with, and if
+// none of the nodes files hold a node list, as when they were lost with the pod's volumes, writes
+// them from it. That way Typesense has a nodes file to start with even if the API server can't be
+// reached yet. An invalid state file is logged and otherwise ignored.
+func restoreState(ctx context.Context) {
+	if stateWriter == nil {
+		return
+	}
+
+	nodes, err := loadState()
+	if err != nil {
+		slog.Warn("ignoring invalid state file", "file", stateWriter.Path, "error", err)
+		return
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	savedNodes = make(map[string][]discovery.Endpoint)
+	for _, n := range nodes {
+		key := sourceKey(n.Cluster, n.Namespace, n.Service)
+		savedNodes[key] = append(savedNodes[key], n)
+	}
+
+	if lastNodes != "" {
+		return
+	}
+
+	nodes = withStaticNodes(nodes)
+	slog.Info("nodes file missing, writing it from the state file", "files", nodesFiles, "state_file", stateWriter.Path, "node_count", len(nodes))
+
+	if _, err := writeNodes(ctx, nodes, nodeOptions.Format(nodes), reasonStateFile); err != nil {
+		slog.Error("failed to write nodes file from the state file", "files", nodesFiles, "error", err)
+	}
+}
+
+// sourceKey returns the key of the source for the given service in the given namespace of the given
+// cluster.
+func sourceKey(cluster, ns, svc string) string {
+	return cluster + "/" + ns + "/" + svc
+}
+
+// validPort reports whether p is a valid port number.
+func validPort(p int) bool {
+	return p > 0 && p <= 65535
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+// statusResponse is the body returned by the status endpoint.
+type statusResponse struct {
+	// Source is the kind of object nodes are discovered from, and Mode whether the nodes listed are
+	// those discovered, or in bootstrap mode those predicted from the StatefulSet.
+	Source string `json:"source"`
+	Mode   string `json:"mode"`
+
+	// Nodes is the node list last found, and Hash a hash of its entries that's the same for any
+	// ordering of them, so that the views of two pods can be compared at a glance.
+	Nodes []string `json:"nodes"`
+	Hash  string   `json:"hash"`
+
+	// Static is the nodes given by -extra-nodes, which are listed whatever is discovered.
+	Static []string `json:"static,omitempty"`
+
+	// Written reports whether the nodes file is known to hold the node list last found.
+	Written   bool       `json:"written"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	// SelfHealthy is whether the local Typesense process last passed its health check, with
+	// -verify-self, and SelfError why it failed if not.
+	SelfHealthy *bool  `json:"self_healthy,omitempty"`
+	SelfError   string `json:"self_error,omitempty"`
+
+	// Degraded is set while some of the sources can't be listed, as during an API server outage,
+	// and the nodes they were last found to have are listed in the meantime.
+	Degraded *degradedStatus `json:"degraded,omitempty"`
+
+	// Raft is the local Typesense node's view of its raft cluster, with -raft-poll-interval.
+	Raft *raftStatus `json:"raft,omitempty"`
+
+	// Files is the state of each of the nodes files, and of the -json-file if there is one, and
+	// Sinks the state of each of the other sinks the node list is written to.
+	Files []fileStatus `json:"files"`
+	Sinks []sinkStatus `json:"sinks,omitempty"`
+}
+
+// degradedStatus is the sources that can't be listed, as reported by the status endpoint.
+type degradedStatus struct {
+	Since   time.Time `json:"since"`
+	Sources []string  `json:"sources"`
+}
+
+// raftStatus is the local Typesense node's view of its raft cluster, as reported by the status
+// endpoint.
+type raftStatus struct {
+	State            string     `json:"state"`
+	CommittedIndex   int64      `json:"committed_index,omitempty"`
+	CheckedAt        time.Time  `json:"checked_at"`
+	Error            string     `json:"error,omitempty"`
+	DisagreeingSince *time.Time `json:"disagreeing_since,omitempty"`
+}
+
+// fileStatus is the state of one of the nodes files, as reported by the status endpoint.
+type fileStatus struct {
+	Path      string     `json:"path"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// sinkStatus is the state of one of the sinks other than the nodes files, as reported by the status
+// endpoint.
+type sinkStatus struct {
+	Name      string     `json:"name"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// status returns the current state, as reported by the status endpoint.
+func (h *healthState) status() statusResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	response := statusResponse{
+		Source:  sourceKind(),
+		Mode:    "discovered",
+		Nodes:   []string{},
+		Written: h.nodes != "" && discovery.Canonical(h.nodes) == discovery.Canonical(h.written),
+	}
+
+	if bootstrapping.Load() {
+		response.Mode = "bootstrap"
+	}
+
+	for _, n := range staticNodes {
+		response.Static = append(response.Static, discovery.FormatNode(n.IP, n.PeerPort, n.APIPort))
+	}
+
+	if h.nodes != "" {
+		response.Nodes = strings.Split(h.nodes, ",")
+
+		sum := sha256.Sum256([]byte(discovery.Canonical(h.nodes)))
+		response.Hash = hex.EncodeToString(sum[:])
+	}
+
+	if !h.lastWrite.IsZero() {
+		lastWrite := h.lastWrite
+		response.LastWrite = &lastWrite
+	}
+
+	if h.lastError != nil {
+		response.LastError = h.lastError.Error()
+	}
+
+	if h.selfChecked {
+		healthy := h.selfError == nil
+		response.SelfHealthy = &healthy
+
+		if h.selfError != nil {
+			response.SelfError = h.selfError.Error()
+		}
+	}
+
+	if len(h.degraded) > 0 {
+		response.Degraded = &degradedStatus{Since: h.degradedSince, Sources: h.degraded}
+	}
+
+	if h.raft != nil {
+		response.Raft = &raftStatus{State: h.raft.State, CommittedIndex: h.raft.CommittedIndex, CheckedAt: h.raft.At}
+
+		if h.raft.Err != nil {
+			response.Raft.State = "unknown"
+			response.Raft.Error = h.raft.Err.Error()
+		}
+
+		if !h.raft.DisagreeingSince.IsZero() {
+			since := h.raft.DisagreeingSince
+			response.Raft.DisagreeingSince = &since
+		}
+	}
+
+	for _, t := range nodesTargets {
+		name := t.sink.Name()
+
+		var lastWrite *time.Time
+		var lastError string
+		if s, ok := h.sinks[name]; ok {
+			if !s.lastWrite.IsZero() {
+				at := s.lastWrite
+				lastWrite = &at
+			}
+
+			if s.lastError != nil {
+				lastError = s.lastError.Error()
+			}
+		}
+
+		if t.file != nil {
+			response.Files = append(response.Files, fileStatus{Path: name, LastWrite: lastWrite, LastError: lastError})
+		} else {
+			response.Sinks = append(response.Sinks, sinkStatus{Name: name, LastWrite: lastWrite, LastError: lastError})
+		}
+	}
+
+	return response
+}
+
+// handleStatus registers the status endpoint on mux.
+func handleStatus(mux *http.ServeMux) {
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health.status())
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// zoneLabel is the well-known label giving the zone a Kubernetes node is in.
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// localZone is the zone this sidecar's pod is in, given by -zone or found by findLocalZone, or empty
+// if it isn't known, in which case -same-zone-only lists nodes in every zone.
+var localZone string
+
+// kubeNodeSelector is the parsed -node-selector flag, or nil if nodes aren't filtered by the labels
+// of the Kubernetes nodes they're on.
+var kubeNodeSelector labels.Selector
+
+// kubeNodeLookup returns the Kubernetes node a node is on, or nil if it isn't known.
+type kubeNodeLookup func(n discovery.Endpoint) (*corev1.Node, error)
+
+// useKubeNodes reports whether nodes depend on the Kubernetes nodes they're on, through
+// -same-zone-only or -node-selector.
+func useKubeNodes() bool {
+	return sameZoneOnly && localZone != "" || kubeNodeSelector != nil
+}
+
+// findLocalZone returns the zone of the Kubernetes node this sidecar's pod, given by -pod-name, is
+// on. If the node has no zone label, it only logs a warning and returns an empty zone.
+func findLocalZone(ctx context.Context, clients kubernetes.Interface) (string, error) {
+	name := podName
+	if name == "" {
+		return "", errors.New("-zone isn't set and -pod-name isn't available to find it from")
+	}
+
+	pod, err := clients.CoreV1().Pods(bootstrapNamespace()).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get own pod %s: %w", name, err)
+	}
+
+	if pod.Spec.NodeName == "" {
+		return "", fmt.Errorf("own pod %s hasn't been scheduled to a node", name)
+	}
+
+	node, err := clients.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get own node %s: %w", pod.Spec.NodeName, err)
+	}
+
+	zone := node.Labels[zoneLabel]
+	if zone == "" {
+		slog.Warn("own node has no zone label, listing nodes in every zone", "node", node.Name, "label", zoneLabel)
+	}
+
+	return zone, nil
+}
+
+// newKubeNodeCache returns an informer caching the Kubernetes nodes of the given cluster, the
+// informer factory that must be started for it to run, and a function getting a Kubernetes node by
+// name from its cache, or nil if it isn't there.
+func newKubeNodeCache(c cluster) (informers.SharedInformerFactory, cache.SharedIndexInformer, func(name string) (*corev1.Node, error)) {
+	factory := informers.NewSharedInformerFactory(c.clients, resyncInterval)
+
+	nodes := factory.Core().V1().Nodes()
+	lister := nodes.Lister()
+
+	return factory, nodes.Informer(), func(name string) (*corev1.Node, error) {
+		node, err := lister.Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return node, err
+	}
+}
+
+// listKubeNodeLookup returns a kubeNodeLookup for the Kubernetes nodes of the given clusters, as
+// listed from their API servers, without going through an informer. Failing to list the nodes of a
+// remote cluster only logs a warning, leaving its Kubernetes nodes unknown.
+func listKubeNodeLookup(ctx context.Context, clusters []cluster) (kubeNodeLookup, error) {
+	byName := make(map[string]*corev1.Node)
+	for _, c := range clusters {
+		list, err := c.clients.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			if c.name == "" {
+				return nil, err
+			}
+
+			slog.Warn("failed to list kubernetes nodes in remote cluster", "cluster", c.name, "error", err)
+			continue
+		}
+
+		for i := range list.Items {
+			node := &list.Items[i]
+			byName[c.name+"/"+node.Name] = node
+		}
+	}
+
+	return func(n discovery.Endpoint) (*corev1.Node, error) {
+		return byName[n.Cluster+"/"+n.NodeName], nil
+	}, nil
+}
+
+// kubeNodeChanged reports whether a Kubernetes node update changes whether the nodes on it are
+// listed.
+func kubeNodeChanged(old, new *corev1.Node) bool {
+	if old.Labels[zoneLabel] != new.Labels[zoneLabel] {
+		return true
+	}
+
+	return kubeNodeSelector != nil && kubeNodeSelector.Matches(labels.Set(old.Labels)) != kubeNodeSelector.Matches(labels.Set(new.Labels))
+}
+
+// kubeNodeSelected returns the nodes on Kubernetes nodes that match -node-selector, if it's set,
+// along with the names of the pods of those that don't. Nodes whose Kubernetes node isn't known are
+// left out too, other than static nodes.
+func kubeNodeSelected(nodes []discovery.Endpoint, lookup kubeNodeLookup) ([]discovery.Endpoint, []string, error) {
+	if kubeNodeSelector == nil {
+		return nodes, nil, nil
+	}
+
+	var excluded []string
+
+	kept := make([]discovery.Endpoint, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Static {
+			kept = append(kept, n)
+			continue
+		}
+
+		var node *corev1.Node
+		if n.NodeName != "" {
+			var err error
+			if node, err = lookup(n); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if node == nil || !kubeNodeSelector.Matches(labels.Set(node.Labels)) {
+			slog.Debug("dropping node whose kubernetes node doesn't match the node selector", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "node", n.NodeName)
+			excluded = append(excluded, path.Join(n.Cluster, n.Namespace, cmp.Or(n.Pod, n.IP)))
+			continue
+		}
+
+		kept = append(kept, n)
+	}
+
+	return kept, excluded, nil
+}
+
+// sameZoneNodes returns the nodes in the same zone as this sidecar's pod, with -same-zone-only. A
+// node's zone comes from its EndpointSlice, where given, or else from the labels of the Kubernetes
+// node it's on. Nodes whose zone isn't known are kept, with a warning, as are static nodes. If the
+// local zone isn't known, every node is kept.
+func sameZoneNodes(nodes []discovery.Endpoint, lookup kubeNodeLookup) ([]discovery.Endpoint, error) {
+	if !sameZoneOnly || localZone == "" {
+		return nodes, nil
+	}
+
+	kept := make([]discovery.Endpoint, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Static {
+			kept = append(kept, n)
+			continue
+		}
+
+		zone := n.Zone
+		if zone == "" && n.NodeName != "" {
+			node, err := lookup(n)
+			if err != nil {
+				return nil, err
+			}
+			if node != nil {
+				zone = node.Labels[zoneLabel]
+			}
+		}
+
+		switch zone {
+		case "":
+			slog.Warn("listing node whose zone isn't known", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "node", n.NodeName)
+			kept = append(kept, n)
+		case localZone:
+			kept = append(kept, n)
+		default:
+			slog.Debug("dropping node in another zone", "ip", n.IP, "namespace", n.Namespace, "pod", n.Pod, "zone", zone, "local_zone", localZone)
+		}
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/discovery"
+)
+
+const (
+	// probeConcurrency is the most health checks that will be made at once.
+	probeConcurrency = 8
+
+	// probeCacheTTL is how long the result of a health check is reused for, so that a burst of
+	// reconciles doesn't hammer the peers.
+	probeCacheTTL = 10 * time.Second
+)
+
+// prober checks the health of Typesense nodes.
+var prober = newHealthProber()
+
+// healthProber checks Typesense nodes' /health endpoints, caching the results briefly.
+type healthProber struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]probeResult
+}
+
+// probeResult is the cached result of a health check.
+type probeResult struct {
+	err error
+	at  time.Time
+}
+
+// newHealthProber returns a new healthProber.
+func newHealthProber() *healthProber {
+	return &healthProber{
+		client: &http.Client{},
+		cache:  make(map[string]probeResult),
+	}
+}
+
+// verifyNodes returns the given nodes, less any that fail their health check, when -verify-peers
+// is set. The nodes that are dropped are logged.
+func verifyNodes(ctx context.Context, nodes []discovery.Endpoint) []discovery.Endpoint {
+	if !verifyPeers {
+		return nodes
+	}
+
+	results := prober.probeAll(ctx, nodes)
+
+	healthy := nodes[:0:0]
+	var dropped []string
+
+	for i, n := range nodes {
+		if results[i] != nil {
+			dropped = append(dropped, fmt.Sprintf("%s (%s)", discovery.FormatNode(nodeOptions.Host(n), n.PeerPort, n.APIPort), results[i]))
+			continue
+		}
+
+		healthy = append(healthy, n)
+	}
+
+	if len(dropped) > 0 {
+		slog.Warn("dropping nodes that failed their health check", "dropped", dropped, "node_count", len(healthy))
+	}
+
+	return healthy
+}
+
+// unreachablePeers is the peering addresses that couldn't be dialled on the last reconcile, with
+// -verify-peer-port.
+var unreachablePeers []string
+
+// verifyPeerPorts returns the given nodes having dialled each of their peering ports, when
+// -verify-peer-port is set, as the API port answering /health doesn't mean raft can reach the peering
+// port. Those that can't be dialled are left out with -verify-peer-port-action=omit, or only reported
+// with report. This sidecar's own node is dialled at 127.0.0.1, as a pod may not be able to reach
+// itself at its own address.
+func verifyPeerPorts(ctx context.Context, nodes []discovery.Endpoint) []discovery.Endpoint {
+	if !verifyPeerPort {
+		return nodes
+	}
+
+	results := make([]error, len(nodes))
+	addrs := make([]string, len(nodes))
+	sem := make(chan struct{}, probeConcurrency)
+
+	var wg sync.WaitGroup
+
+	for i, n := range nodes {
+		addrs[i] = net.JoinHostPort(nodeOptions.Host(n), strconv.Itoa(n.PeerPort))
+
+		dial := addrs[i]
+		if ownNode(n) {
+			dial = net.JoinHostPort("127.0.0.1", strconv.Itoa(n.PeerPort))
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var d net.Dialer
+			ctx, cancel := context.WithTimeout(ctx, verifyPeerPortTimeout)
+			defer cancel()
+
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			results[i] = err
+		}(i, dial)
+	}
+
+	wg.Wait()
+
+	peerUnreachableGauge.Reset()
+	unreachablePeers = nil
+
+	kept := nodes[:0:0]
+	for i, n := range nodes {
+		if results[i] == nil {
+			kept = append(kept, n)
+			continue
+		}
+
+		peerUnreachableGauge.WithLabelValues(addrs[i]).Set(1)
+		unreachablePeers = append(unreachablePeers, addrs[i])
+		slog.Debug("failed to dial peering port", "address", addrs[i], "pod", n.Pod, "error", results[i])
+
+		if verifyPeerPortAction != "omit" {
+			kept = append(kept, n)
+		}
+	}
+
+	switch {
+	case len(unreachablePeers) == 0:
+	case verifyPeerPortAction == "omit":
+		slog.Warn("dropping nodes whose peering port can't be reached", "unreachable", unreachablePeers, "node_count", len(kept))
+	default:
+		slog.Warn("nodes' peering ports can't be reached", "unreachable", unreachablePeers, "node_count", len(kept))
+	}
+
+	return kept
+}
+
+// ownNode reports whether the node is this sidecar's own, the one for -pod-name. No node is when the
+// pod's name isn't known.
+func ownNode(n discovery.Endpoint) bool {
+	return podName != "" && n.Pod == podName && (podNamespace == "" || n.Namespace == podNamespace)
+}
+
+// verifySelf returns the given nodes, having checked the health of the local Typesense process when
+// -verify-self is set. If it's unhealthy, this sidecar's own node, the one for -pod-name, is left
+// out with -verify-self-action=omit, or only reported with report. It's checked again on every
+// reconcile, so the node is listed again once the local process recovers.
+func verifySelf(ctx context.Context, nodes []discovery.Endpoint) []discovery.Endpoint {
+	if !verifySelfHealth {
+		return nodes
+	}
+
+	err := prober.probe(ctx, net.JoinHostPort("127.0.0.1", strconv.Itoa(apiPort)))
+	health.setSelfError(err)
+
+	if err == nil {
+		selfUnhealthyGauge.Set(0)
+		return nodes
+	}
+
+	selfUnhealthyGauge.Set(1)
+
+	if verifySelfAction != "omit" {
+		slog.Warn("local typesense process failed its health check", "pod", podName, "error", err)
+		return nodes
+	}
+
+	kept := nodes[:0:0]
+	for _, n := range nodes {
+		if !ownNode(n) {
+			kept = append(kept, n)
+		}
+	}
+
+	slog.Warn("local typesense process failed its health check, leaving its node out", "pod", podName, "dropped", len(nodes)-len(kept), "error", err)
+
+	return kept
+}
+
+// probeAll checks the health of each node, with bounded concurrency, returning the result for the
+// node at the same index. This sidecar's own node is checked at 127.0.0.1, as with verifyPeerPorts,
+// so that a pod that can't reach itself at its own address doesn't leave itself out.
+func (p *healthProber) probeAll(ctx context.Context, nodes []discovery.Endpoint) []error {
+	results := make([]error, len(nodes))
+	sem := make(chan struct{}, probeConcurrency)
+
+	var wg sync.WaitGroup
+
+	for i, n := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, n discovery.Endpoint) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			host := nodeOptions.Host(n)
+			if ownNode(n) {
+				host = "127.0.0.1"
+			}
+
+			results[i] = p.probe(ctx, net.JoinHostPort(host, strconv.Itoa(n.APIPort)))
+		}(i, n)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// probe checks the health of the Typesense node whose API is at the given host and port, reusing a
+// recent result if there is one.
+func (p *healthProber) probe(ctx context.Context, hostPort string) error {
+	p.mu.Lock()
+	cached, ok := p.cache[hostPort]
+	p.mu.Unlock()
+
+	if ok && time.Since(cached.at) < probeCacheTTL {
+		return cached.err
+	}
+
+	err := p.check(ctx, "http://"+hostPort+"/health")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Expire old entries as we go, so nodes that have gone away don't linger.
+	for k, r := range p.cache {
+		if time.Since(r.at) >= probeCacheTTL {
+			delete(p.cache, k)
+		}
+	}
+
+	p.cache[hostPort] = probeResult{err: err, at: time.Now()}
+
+	return err
+}
+
+// check makes a request to a Typesense /health endpoint, returning an error unless it reports that
+// the node is healthy.
+func (p *healthProber) check(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyPeersTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	var body struct {
+		OK bool `json:"ok"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if !body.OK {
+		return fmt.Errorf("node reports it isn't healthy")
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seeruk/tsns/pkg/sink"
+)
+
+// webhookBackoff is how long to wait before retrying a -webhook-url delivery the first time. The wait
+// doubles for each retry after that.
+const webhookBackoff = time.Second
+
+// webhookSignatureHeader is the header a -webhook-url delivery is signed in, with
+// -webhook-secret-env, as sha256= followed by the hex HMAC-SHA256 of the body.
+const webhookSignatureHeader = "X-Tsns-Signature"
+
+// webhookHeaders holds the headers given by -webhook-header, sent with every delivery.
+var webhookHeaders = make(http.Header)
+
+// parseWebhookHeader adds the header given as Name: value to the -webhook-header headers.
+func parseWebhookHeader(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return fmt.Errorf("invalid header %q, must be Name: value", value)
+	}
+
+	webhookHeaders.Add(name, strings.TrimSpace(v))
+	return nil
+}
+
+// validateWebhookURL returns an error if -webhook-url isn't an http or https URL.
+func validateWebhookURL() error {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q, must be an http or https URL", u.Redacted())
+	}
+
+	return nil
+}
+
+// webhookSink is a sink.Sink that POSTs the node list to -webhook-url as a JSON document, in the same
+// format as the -json-file, signed with the secret in -webhook-secret-env if that's set. Deliveries
+// are made in the background, so that they never hold up the nodes file, and are retried, backing
+// off between attempts, up to -webhook-attempts times. A node list that still couldn't be delivered
+// is tried again after -write-retry-after, and so on until it is, unless the node list changes again
+// first, in which case the newer one is delivered instead.
+type webhookSink struct {
+	// pending holds the delivery waiting to be made, if any.
+	pending chan webhookDelivery
+
+	// background is whether deliveries are made in the background. With -once they're made
+	// straight away instead, so that they're done before tsns exits.
+	background bool
+
+	// generation is the number of node lists queued for delivery so far. It's only counted from
+	// when tsns started, so it orders deliveries from the same process, and starts again from 1
+	// after a restart. Deliveries from different processes are ordered by their generated_at.
+	generation int
+}
+
+// webhookDelivery is a node list to be delivered, along with its generation.
+type webhookDelivery struct {
+	nodes      sink.NodeList
+	generation int
+}
+
+// newWebhookSink returns a webhookSink, delivering in the background until ctx is done if
+// background is set.
+func newWebhookSink(ctx context.Context, background bool) *webhookSink {
+	s := &webhookSink{pending: make(chan webhookDelivery, 1), background: background}
+	if background {
+		go s.run(ctx)
+	}
+
+	return s
+}
+
+// Name returns the webhook URL, without any password in it.
+func (s *webhookSink) Name() string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "webhook"
+	}
+
+	return "webhook/" + u.Redacted()
+}
+
+// Write queues the node list for delivery, replacing any node list still waiting, or without
+// background delivery, delivers it straight away.
+func (s *webhookSink) Write(ctx context.Context, nodes sink.NodeList) error {
+	s.generation++
+	d := webhookDelivery{nodes: nodes, generation: s.generation}
+
+	if !s.background {
+		return s.deliver(ctx, d)
+	}
+
+	select {
+	case <-s.pending:
+	default:
+	}
+	s.pending <- d
+
+	return nil
+}
+
+// run makes queued deliveries until ctx is done, recording how each went in the sink's status. A
+// delivery that fails is made again after -write-retry-after, unless a newer one is queued first.
+func (s *webhookSink) run(ctx context.Context) {
+	var failed webhookDelivery
+	var retry <-chan time.Time
+
+	for {
+		var d webhookDelivery
+
+		select {
+		case d = <-s.pending:
+		case <-retry:
+			d = failed
+			slog.Info("retrying webhook delivery", "url", s.Name(), "generation", d.generation)
+		case <-ctx.Done():
+			return
+		}
+
+		retry = nil
+
+		if err := s.deliver(ctx, d); err != nil {
+			health.recordSinkError(s.Name(), err)
+			failed, retry = d, time.After(writeRetryAfter)
+			continue
+		}
+
+		health.recordSinkWrite(s.Name())
+	}
+}
+
+// deliver POSTs the node list to the webhook, retrying failed requests, returning the last error if
+// every attempt failed.
+func (s *webhookSink) deliver(ctx context.Context, d webhookDelivery) error {
+	body, err := json.Marshal(jsonDocument{
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Generation:  d.generation,
+		Source:      sourceKind(),
+		Nodes:       nodeOptions.Nodes(d.nodes.Endpoints),
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookBackoff
+
+	for attempt := 1; ; attempt++ {
+		status, err := webhookRequest(ctx, body)
+
+		result := "error"
+		if status != 0 {
+			result = strconv.Itoa(status)
+		}
+		webhookRequestsTotal.WithLabelValues(result).Inc()
+
+		if err == nil {
+			slog.Info("delivered node list to webhook", "url", s.Name(), "generation", d.generation, "status", status, "attempts", attempt)
+			return nil
+		}
+
+		if attempt >= webhookAttempts || ctx.Err() != nil {
+			webhookFailuresTotal.Inc()
+			slog.Warn("failed to deliver node list to webhook", "url", s.Name(), "generation", d.generation, "attempts", attempt, "error", err)
+			return err
+		}
+
+		slog.Debug("failed to deliver node list to webhook, retrying", "url", s.Name(), "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+
+		// A newer node list makes this one moot, so it's delivered instead.
+		if len(s.pending) > 0 {
+			slog.Debug("giving up on webhook delivery for a newer node list", "url", s.Name(), "generation", d.generation)
+			return err
+		}
+
+		backoff *= 2
+	}
+}
+
+// webhookRequest makes a single -webhook-url request with the given body, returning the response
+// status, if there was one. Any status other than 2xx is an error.
+func webhookRequest(ctx context.Context, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	for name, values := range webhookHeaders {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if webhookSecretEnv != "" {
+		mac := hmac.New(sha256.New, []byte(os.Getenv(webhookSecretEnv)))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}